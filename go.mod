@@ -1,10 +1,37 @@
-module authenticating-route-service
+module github.com/OllieJC/authenticating-route-service
+
+go 1.19
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/cloudfoundry-community/go-cfenv v1.18.0
-	github.com/jarcoal/httpmock v1.0.4
+	github.com/envoyproxy/go-control-plane v0.11.1
+	github.com/gomodule/redigo v1.8.9
 	github.com/onsi/ginkgo v1.10.3
 	github.com/onsi/gomega v1.7.1
-	golang.org/x/oauth2 v0.0.0-20191202225959-858c2ad4c8b6
-	gopkg.in/yaml.v2 v2.2.4
+	golang.org/x/crypto v0.0.0-20211108221036-ceb1ce70b4fa
+	golang.org/x/net v0.10.0
+	golang.org/x/oauth2 v0.7.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230526203410-71b5a4ffd15e
+	google.golang.org/grpc v1.56.3
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	cloud.google.com/go/compute v1.19.1 // indirect
+	cloud.google.com/go/compute/metadata v0.2.3 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cncf/xds/go v0.0.0-20230607035331-e9ce68804cb4 // indirect
+	github.com/envoyproxy/protoc-gen-validate v1.0.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/hpcloud/tail v1.0.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20200816102855-ee81675732da // indirect
+	golang.org/x/sys v0.8.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
+	google.golang.org/appengine v1.6.7 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+	gopkg.in/fsnotify.v1 v1.4.7 // indirect
+	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v2 v2.2.4 // indirect
 )
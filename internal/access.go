@@ -0,0 +1,51 @@
+package internal
+
+import (
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+	"net/http"
+)
+
+// GetIdentity returns the normalised identity held in the session
+func GetIdentity(sess CustomSession) (p.Identity, bool) {
+	idp, ok := p.Get(sess.Provider)
+	if !ok {
+		return p.Identity{Provider: sess.Provider}, false
+	}
+
+	ident, err := idp.Identity(sess.UserData)
+	if err != nil {
+		Debugfln("GetIdentity: %#v", err)
+		return p.Identity{Provider: sess.Provider}, false
+	}
+
+	return ident, true
+}
+
+// IsAuthorised returns true if the first access rule matching the request allows the
+// session's user, or if no access rule matches
+func IsAuthorised(request *http.Request, sess CustomSession) bool {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil {
+		return false
+	}
+
+	reqPath := c.CleanPath(request.URL)
+
+	rule, found := dc.GetAccessRule(request.Method, reqPath)
+	if !found {
+		return true
+	}
+
+	ident, ok := GetIdentity(sess)
+	if !ok {
+		Debugfln("IsAuthorised: No identity for provider '%s'", sess.Provider)
+		return false
+	}
+
+	allowed := rule.Allows(ident.Email, ident.Groups)
+	Debugfln("IsAuthorised: %s allowed: %t", ident.Email, allowed)
+
+	return allowed
+}
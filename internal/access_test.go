@@ -0,0 +1,66 @@
+package internal_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal"
+)
+
+var _ = Describe("Access", func() {
+	githubSession := func(email string, orgs string) s.CustomSession {
+		sess := s.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "` + email + `", "organisations": [` + orgs + `]}`
+		return sess
+	}
+
+	It("should allow any session when no access rule matches", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+
+		Expect(s.IsAuthorised(request, githubSession("someone@elsewhere.local", ""))).To(BeTrue())
+	})
+
+	It("should allow users listed by the matching access rule", func() {
+		request := httptest.NewRequest("GET", "http://example.local/admin", nil)
+
+		Expect(s.IsAuthorised(request, githubSession("admin@email.example.local", ""))).To(BeTrue())
+		Expect(s.IsAuthorised(request, githubSession("someone@elsewhere.local", `"example-org"`))).To(BeTrue())
+	})
+
+	It("should not allow users missing from the matching access rule", func() {
+		request := httptest.NewRequest("POST", "http://example.local/admin/users", nil)
+
+		Expect(s.IsAuthorised(request, githubSession("someone@email.example.local", `"other-org"`))).To(BeFalse())
+	})
+
+	It("should match access rules against the decoded and cleaned path", func() {
+		for _, target := range []string{"/%61dmin", "/%2561dmin/../%61dmin", "/public/../admin", "//admin", "/./admin/"} {
+			request := httptest.NewRequest("GET", "http://example.local"+target, nil)
+
+			Expect(s.IsAuthorised(request, githubSession("someone@email.example.local", `"other-org"`))).To(BeFalse(), target)
+		}
+
+		request := httptest.NewRequest("GET", "http://example.local/private/%31%32", nil)
+		Expect(s.IsAuthorised(request, githubSession("admin@email.example.local", ""))).To(BeFalse())
+	})
+
+	It("should not allow a session without a known identity when a rule matches", func() {
+		request := httptest.NewRequest("GET", "http://example.local/admin", nil)
+
+		sess := s.NewCustomSession()
+		sess.Provider = "Test"
+		sess.UserData = "abc123"
+
+		Expect(s.IsAuthorised(request, sess)).To(BeFalse())
+	})
+
+	It("should return the identity from a session with GetIdentity", func() {
+		ident, ok := s.GetIdentity(githubSession("admin@email.example.local", `"example-org"`))
+		Expect(ok).To(BeTrue())
+		Expect(ident.User).To(Equal("octocat"))
+		Expect(ident.Groups).To(ConsistOf("example-org"))
+	})
+})
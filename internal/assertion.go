@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+	u "github.com/OllieJC/authenticating-route-service/internal/utils"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+)
+
+const (
+	defaultAssertionHeader = "X-Auth-Assertion"
+	defaultAssertionTTL    = 60
+)
+
+var errNoAssertionKeys error = errors.New("No JWT assertion keys configured")
+
+type assertionKey struct {
+	kid    string
+	alg    string
+	signer crypto.Signer
+}
+
+var (
+	assertionKeysMu sync.Mutex
+	assertionKeys   = map[string]assertionKey{}
+)
+
+// loadAssertionKey parses a configured key, parsed keys are cached by their PEM data
+func loadAssertionKey(k c.JWTKey) (assertionKey, error) {
+	cacheKey := k.KeyID + "\x00" + k.Algorithm + "\x00" + k.PrivateKey
+
+	assertionKeysMu.Lock()
+	defer assertionKeysMu.Unlock()
+
+	if ak, ok := assertionKeys[cacheKey]; ok {
+		return ak, nil
+	}
+
+	signer, err := j.ParsePrivateKey([]byte(k.PrivateKey))
+	if err != nil {
+		return assertionKey{}, fmt.Errorf("JWT assertion key '%s': %s", k.KeyID, err.Error())
+	}
+
+	alg := k.Algorithm
+	if alg == "" {
+		alg, err = j.DefaultAlgorithm(signer.Public())
+		if err != nil {
+			return assertionKey{}, fmt.Errorf("JWT assertion key '%s': %s", k.KeyID, err.Error())
+		}
+	}
+
+	ak := assertionKey{kid: k.KeyID, alg: alg, signer: signer}
+	assertionKeys[cacheKey] = ak
+	return ak, nil
+}
+
+func assertionHeaderName(dc c.DomainConfig) string {
+	if dc.JWTAssertion.Header != "" {
+		return dc.JWTAssertion.Header
+	}
+	return defaultAssertionHeader
+}
+
+// NewAssertion returns a JWT of the session's identity signed with the domain's first key
+func NewAssertion(dc c.DomainConfig, sess CustomSession) (string, error) {
+	if len(dc.JWTAssertion.Keys) == 0 {
+		return "", errNoAssertionKeys
+	}
+
+	ak, err := loadAssertionKey(dc.JWTAssertion.Keys[0])
+	if err != nil {
+		return "", err
+	}
+
+	ident, ok := GetIdentity(sess)
+	if !ok {
+		return "", fmt.Errorf("No identity for provider '%s'", sess.Provider)
+	}
+
+	ttl := dc.JWTAssertion.TTL
+	if ttl <= 0 {
+		ttl = defaultAssertionTTL
+	}
+
+	audience := dc.JWTAssertion.Audience
+	if audience == "" {
+		audience = dc.Domain
+	}
+
+	jti, _ := u.GenerateRandomBytes(16, true)
+	now := time.Now()
+
+	claims := j.Claims{
+		"iss":      fmt.Sprintf("https://%s/auth", dc.Domain),
+		"aud":      audience,
+		"sub":      ident.User,
+		"email":    ident.Email,
+		"name":     ident.Name,
+		"provider": ident.Provider,
+		"groups":   ident.Groups,
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(time.Duration(ttl) * time.Second).Unix(),
+		"jti":      string(jti),
+	}
+
+	return j.Sign(claims, ak.alg, ak.kid, ak.signer)
+}
+
+// StripAssertionHeaders removes any client supplied copies of the assertion header
+func StripAssertionHeaders(request *http.Request) {
+	dc, _ := c.GetDomainConfigFromRequest(request)
+
+	request.Header.Del(defaultAssertionHeader)
+	request.Header.Del(assertionHeaderName(dc))
+}
+
+// SetAssertionHeader strips any client supplied assertion header from the request to the
+// backend and, if the domain has JWT assertion keys and the session is valid, adds a new one
+func SetAssertionHeader(request *http.Request, sess CustomSession, authenticated bool) error {
+	dc, _ := c.GetDomainConfigFromRequest(request)
+
+	StripAssertionHeaders(request)
+
+	if !authenticated || len(dc.JWTAssertion.Keys) == 0 {
+		return nil
+	}
+
+	assertion, err := NewAssertion(dc, sess)
+	if err != nil {
+		Debugfln("SetAssertionHeader:err: %s", err.Error())
+		return err
+	}
+
+	request.Header.Set(assertionHeaderName(dc), assertion)
+	return nil
+}
+
+// JWKSResponse returns the public keys used to sign the domain's JWT assertions
+func JWKSResponse(request *http.Request) (*http.Response, error) {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil || len(dc.JWTAssertion.Keys) == 0 {
+		return h.HTTPNotFoundResponse(errNoAssertionKeys), nil
+	}
+
+	var jwks j.JWKS
+	for _, k := range dc.JWTAssertion.Keys {
+		ak, err := loadAssertionKey(k)
+		if err != nil {
+			return h.HTTPErrorResponse(err), err
+		}
+
+		jwk, err := j.NewJWK(ak.signer.Public(), ak.kid, ak.alg)
+		if err != nil {
+			return h.HTTPErrorResponse(err), err
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	body, err := json.Marshal(jwks)
+	if err != nil {
+		return h.HTTPErrorResponse(err), err
+	}
+
+	response := h.EmptyHTTPResponse(request)
+	response.Status = "OK"
+	response.StatusCode = http.StatusOK
+	response.Header.Set("Content-Type", "application/json")
+	response.Header.Set("Cache-Control", "max-age=300, public")
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return response, nil
+}
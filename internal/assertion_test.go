@@ -0,0 +1,103 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal"
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+)
+
+var _ = Describe("Assertion", func() {
+	githubSession := func() s.CustomSession {
+		sess := s.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "octocat@email.example.local", "organisations": ["example-org"]}`
+		return sess
+	}
+
+	getJWKS := func() j.JWKS {
+		request := httptest.NewRequest("GET", "http://example.local/auth/.well-known/jwks.json", nil)
+
+		response, err := s.AuthRequestDecision(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		body, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+
+		var jwks j.JWKS
+		Expect(json.Unmarshal(body, &jwks)).To(Succeed())
+		return jwks
+	}
+
+	It("should publish all of the configured keys", func() {
+		jwks := getJWKS()
+
+		Expect(jwks.Keys).To(HaveLen(2))
+		Expect(jwks.Keys[0].KeyID).To(Equal("ec-2"))
+		Expect(jwks.Keys[0].Algorithm).To(Equal("ES256"))
+		Expect(jwks.Keys[1].KeyID).To(Equal("rsa-1"))
+		Expect(jwks.Keys[1].Algorithm).To(Equal("RS256"))
+	})
+
+	It("should return a 404 for the JWKS of a domain without keys", func() {
+		request := httptest.NewRequest("GET", "http://unconfigured.local/auth/.well-known/jwks.json", nil)
+
+		response, err := s.AuthRequestDecision(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should add an assertion signed with the first key which verifies with the JWKS", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+
+		Expect(s.SetAssertionHeader(request, githubSession(), true)).To(Succeed())
+
+		token, err := j.Parse(request.Header.Get("X-Auth-JWT"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Header.KeyID).To(Equal("ec-2"))
+
+		jwk, ok := getJWKS().Key(token.Header.KeyID)
+		Expect(ok).To(BeTrue())
+		pub, err := jwk.PublicKey()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Verify(pub)).To(Succeed())
+
+		Expect(token.Claims.String("iss")).To(Equal("https://example.local/auth"))
+		Expect(token.Claims.Audience()).To(Equal([]string{"example.local"}))
+		Expect(token.Claims.String("sub")).To(Equal("octocat"))
+		Expect(token.Claims.String("email")).To(Equal("octocat@email.example.local"))
+		Expect(token.Claims["groups"]).To(ConsistOf("example-org"))
+
+		exp, ok := token.Claims.Time("exp")
+		Expect(ok).To(BeTrue())
+		Expect(exp).To(BeTemporally("~", time.Now().Add(120*time.Second), 5*time.Second))
+	})
+
+	It("should strip a client supplied assertion without a session", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+		request.Header.Set("X-Auth-JWT", "forged")
+		request.Header.Set("X-Auth-Assertion", "forged")
+
+		Expect(s.SetAssertionHeader(request, s.NewCustomSession(), false)).To(Succeed())
+
+		Expect(request.Header.Get("X-Auth-JWT")).To(BeEmpty())
+		Expect(request.Header.Get("X-Auth-Assertion")).To(BeEmpty())
+	})
+
+	It("should not add an assertion for a domain without keys", func() {
+		request := httptest.NewRequest("GET", "http://unconfigured.local/anything", nil)
+
+		Expect(s.SetAssertionHeader(request, githubSession(), true)).To(Succeed())
+
+		Expect(request.Header.Get("X-Auth-Assertion")).To(BeEmpty())
+	})
+})
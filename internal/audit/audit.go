@@ -0,0 +1,36 @@
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event logs a security relevant event as a single "AUDIT" prefixed JSON line
+func Event(name string, request *http.Request, fields map[string]string) string {
+	entry := map[string]string{}
+	for k, v := range fields {
+		entry[k] = v
+	}
+
+	entry["event"] = name
+	entry["time"] = time.Now().UTC().Format(time.RFC3339)
+	if request != nil && request.URL != nil {
+		entry["host"] = request.URL.Hostname()
+		entry["path"] = request.URL.EscapedPath()
+		entry["remote_addr"] = request.RemoteAddr
+		if ff := request.Header.Get("X-Forwarded-For"); ff != "" {
+			entry["forwarded_for"] = ff
+		}
+	}
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return ""
+	}
+
+	res := "AUDIT " + string(b)
+	log.Println(res)
+	return res
+}
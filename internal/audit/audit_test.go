@@ -0,0 +1,36 @@
+package audit_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	a "github.com/OllieJC/authenticating-route-service/internal/audit"
+)
+
+var _ = Describe("Audit", func() {
+	It("should return a JSON line with the event, fields and request details", func() {
+		request, _ := http.NewRequest("GET", "http://example.local/auth/callback/google/email.example.local", nil)
+		request.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+		line := a.Event("test_event", request, map[string]string{"email": "test@email.example.local", "event": "overridden"})
+		Expect(line).To(HavePrefix("AUDIT "))
+
+		var entry map[string]string
+		Expect(json.Unmarshal([]byte(strings.TrimPrefix(line, "AUDIT ")), &entry)).To(Succeed())
+		Expect(entry["event"]).To(Equal("test_event"))
+		Expect(entry["email"]).To(Equal("test@email.example.local"))
+		Expect(entry["host"]).To(Equal("example.local"))
+		Expect(entry["path"]).To(Equal("/auth/callback/google/email.example.local"))
+		Expect(entry["forwarded_for"]).To(Equal("10.0.0.1"))
+		Expect(entry["time"]).NotTo(BeEmpty())
+	})
+
+	It("should not need a request", func() {
+		line := a.Event("test_event", nil, nil)
+		Expect(line).To(ContainSubstring(`"event":"test_event"`))
+	})
+})
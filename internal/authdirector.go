@@ -1,10 +1,6 @@
 package internal
 
 import (
-	c "authenticating-route-service/internal/configurator"
-	g "authenticating-route-service/internal/google"
-	h "authenticating-route-service/internal/httphelper"
-	. "authenticating-route-service/pkg/debugprint"
 	"bytes"
 	"errors"
 	"io/ioutil"
@@ -13,6 +9,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
 )
 
 const (
@@ -53,8 +54,16 @@ func AuthIDPDirector(request *http.Request, response *http.Response) error {
 		}
 
 		led := dc.GetLoginEmailDomain(domain, provider)
-		if led.Provider == "google" {
-			g.OAuthGoogleLogin(response, dc, domain)
+		if led.Provider != "" {
+			idp, ok := p.Get(led.Provider)
+			if !ok {
+				return errBadProvider
+			}
+
+			err = idp.Login(request, response, dc, domain)
+			if err != nil {
+				return err
+			}
 
 			Debugfln("AuthIDPDirector:2: Returning good email.")
 
@@ -151,6 +160,12 @@ func returnAsset(request *http.Request) (*http.Response, error) {
 	return h.HTTPNotFoundResponse(err), nil
 }
 
+// IsAuthPath returns true if the escaped path is one of the route service's own pages under
+// /auth/, not an upstream path which only starts with "/auth" such as "/authors"
+func IsAuthPath(escapedPath string) bool {
+	return escapedPath == "/auth" || strings.HasPrefix(escapedPath, "/auth/")
+}
+
 func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 
 	Debugfln("AuthRequestDecision:1: Starting...")
@@ -169,6 +184,12 @@ func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 		response.StatusCode = http.StatusOK
 		response.Body = ioutil.NopCloser(bytes.NewReader(body))
 
+	} else if escapedPath == "/auth/.well-known/jwks.json" && request.Method == "GET" {
+
+		Debugfln("AuthRequestDecision:2: JWKS")
+
+		return JWKSResponse(request)
+
 	} else if strings.HasPrefix(escapedPath, "/auth/assets") && request.Method == "GET" {
 
 		Debugfln("AuthRequestDecision:2: Asset")
@@ -190,8 +211,21 @@ func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 
 		Debugfln("AuthRequestDecision:3: GET /auth/logout")
 
-		h.RemoveCookie(response, GetSessionCookieName(request))
-		h.RedirectResponse(response, http.StatusSeeOther, "/auth/login")
+		logoutURL := "/auth/login"
+		if ok, sess := CheckCookie(request); ok {
+			if err = RevokeSession(sess.ID); err != nil {
+				Debugfln("AuthRequestDecision:3:err: %s", err.Error())
+			}
+			if idp, found := p.Get(sess.Provider); found {
+				dc, _ := c.GetDomainConfigFromRequest(request)
+				if u := idp.LogoutURL(dc, sess.UserData); u != "" {
+					logoutURL = u
+				}
+			}
+		}
+
+		h.RemoveDomainCookie(response, GetSessionCookieName(request), GetSessionCookieDomain(request))
+		h.RedirectResponse(response, http.StatusSeeOther, logoutURL)
 
 	} else if escapedPath == "/auth/login" && request.Method == "POST" {
 
@@ -203,6 +237,8 @@ func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 			tpd := h.NewTemplatePageData()
 			tpd.Title = "Bad Email"
 			response, err = h.TemplateResponse("bad-email.html", http.StatusUnauthorized, tpd)
+		} else if err == errBadProvider {
+			return h.HTTPStatusResponse(http.StatusBadRequest, "Bad Provider", err), nil
 		}
 
 		if err != nil {
@@ -221,17 +257,36 @@ func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 		}
 
 		sep := strings.Split(escapedPath, "/")
+		if len(sep) < 5 {
+			return h.HTTPNotFoundResponse(nil), nil
+		}
+
 		provider := sep[3]
+		idp, ok := p.Get(provider)
+		if !ok {
+			Debugfln("AuthRequestDecision:5: Unknown provider: %s", provider)
+
+			return h.HTTPStatusResponse(http.StatusNotFound, "Bad Provider", errBadProvider), nil
+		}
 
-		var cbResp string
+		cbResp, err := idp.Callback(request, response, dc)
+		if errors.Is(err, p.ErrAccountMismatch) {
+			Debugfln("AuthRequestDecision:5:err: %s", err.Error())
 
-		if provider == g.ProviderString {
-			cbResp, err = g.OauthGoogleCallback(request, response, dc)
+			tpd := h.NewTemplatePageData()
+			tpd.Title = "Wrong Account"
+			tpd.ErrorText = err.Error()
+			response, err = h.TemplateResponse("wrong-account.html", http.StatusForbidden, tpd)
 			if err != nil {
-				Debugfln("AuthRequestDecision:5:err: %s", err.Error())
-
 				return h.HTTPErrorResponse(err), err
 			}
+			h.RemoveDomainCookie(response, GetSessionCookieName(request), GetSessionCookieDomain(request))
+
+			return response, nil
+		} else if err != nil {
+			Debugfln("AuthRequestDecision:5:err: %s", err.Error())
+
+			return h.HTTPErrorResponse(err), err
 		}
 
 		redirectPath := "/"
@@ -243,7 +298,7 @@ func AuthRequestDecision(request *http.Request) (*http.Response, error) {
 		}
 
 		if cbResp != "" {
-			AddCookie(request, response, provider, cbResp)
+			AddCookie(request, response, idp.Name(), cbResp)
 			h.RedirectResponse(response, http.StatusSeeOther, redirectPath)
 		}
 
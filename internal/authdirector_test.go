@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"strconv"
@@ -14,7 +15,12 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	s "authenticating-route-service/internal"
+	s "github.com/OllieJC/authenticating-route-service/internal"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	gh "github.com/OllieJC/authenticating-route-service/internal/github"
+	g "github.com/OllieJC/authenticating-route-service/internal/google"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
 )
 
 var _ = Describe("AuthDirector", func() {
@@ -56,6 +62,24 @@ var _ = Describe("AuthDirector", func() {
 			Expect(resp.StatusCode).To(Equal(http.StatusSeeOther))
 		})
 
+		It("should return a GitHub redirect with a GitHub email domain", func() {
+			ghReq, _ := http.NewRequest("POST", "http://example.local/auth/login", nil)
+			ghReq.PostForm = url.Values{
+				"email":    {"test@third.example.local"},
+				"provider": {"github"},
+			}
+			ghResp := &http.Response{Header: http.Header{}}
+
+			err := s.AuthIDPDirector(ghReq, ghResp)
+
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ghResp.StatusCode).To(Equal(http.StatusSeeOther))
+
+			loc, err := ghResp.Location()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loc.Hostname()).To(Equal("github.com"))
+		})
+
 		It("should return an error if not a post request", func() {
 			req.Method = "GET"
 
@@ -227,6 +251,125 @@ var _ = Describe("AuthDirector", func() {
 			Expect(cookieRaw).Should(ContainSubstring(expectedYear))
 		})
 
+		It("should return a bad provider page when posting an email domain with an unknown provider", func() {
+			// a config file with an unknown provider doesn't validate, but a registered one isn't checked
+			defer c.Unregister("unknown-provider.example.local")
+			c.Register(c.DomainConfig{
+				Domain:             "unknown-provider.example.local",
+				Enabled:            true,
+				SessionServerToken: "0123456789abcdef0123456789abcdef",
+				LoginEmailDomains:  []c.LoginEmailDomain{{Domain: "second.example.local", Provider: "none"}},
+			})
+
+			req, _ := http.NewRequest("POST", "http://unknown-provider.example.local/auth/login", nil)
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			req.PostForm = url.Values{
+				"email":    {"test@second.example.local"},
+				"provider": {"none"},
+			}
+
+			resp, err := s.AuthRequestDecision(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bodyBytes)).To(ContainSubstring("Provider not recognised"))
+		})
+
+		It("should return a bad provider page for a callback to an unknown provider", func() {
+			req, _ := http.NewRequest("GET", "http://example.local/auth/callback/unknown/email.example.local", nil)
+
+			resp, err := s.AuthRequestDecision(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bodyBytes)).To(ContainSubstring("Provider not recognised"))
+		})
+
+		It("should return the wrong account page when Google returns another domain's account", func() {
+			fakeGoogle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Path == "/token" {
+					fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer"}`)
+					return
+				}
+				fmt.Fprint(w, `{"email": "someone@gmail.com", "verified_email": true}`)
+			}))
+			defer fakeGoogle.Close()
+
+			originalEndpoint, originalUserInfoURL := g.Endpoint, g.UserInfoURL
+			defer func() {
+				g.Endpoint, g.UserInfoURL = originalEndpoint, originalUserInfoURL
+				p.ResetOAuthConfigCaches()
+			}()
+			g.Endpoint.TokenURL = fakeGoogle.URL + "/token"
+			g.UserInfoURL = fakeGoogle.URL + "/userinfo"
+			p.ResetOAuthConfigCaches()
+
+			stateResponse := h.EmptyHTTPResponse(nil)
+			state := h.GenerateStateOauthCookie(stateResponse)
+
+			req, _ := http.NewRequest("GET", "http://example.local/auth/callback/google/email.example.local", nil)
+			req.Header.Add("Cookie", stateResponse.Header.Get("Set-Cookie"))
+			req.Form = url.Values{"state": {state}, "code": {"xxx"}}
+
+			resp, err := s.AuthRequestDecision(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bodyBytes)).To(ContainSubstring("Wrong Account"))
+			Expect(string(bodyBytes)).To(ContainSubstring("someone@gmail.com"))
+		})
+
+		It("should return the wrong account page when the GitHub user isn't in an allowed organisation", func() {
+			fakeGitHub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/token":
+					fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer"}`)
+				case "/user":
+					fmt.Fprint(w, `{"login": "octocat", "name": "Octocat"}`)
+				case "/user/emails":
+					fmt.Fprint(w, `[{"email": "octocat@third.example.local", "primary": true, "verified": true}]`)
+				case "/user/orgs":
+					fmt.Fprint(w, `[{"login": "some-org"}]`)
+				default:
+					fmt.Fprint(w, `[]`)
+				}
+			}))
+			defer fakeGitHub.Close()
+
+			originalEndpoint, originalAPIURL := gh.Endpoint, gh.APIURL
+			defer func() {
+				gh.Endpoint, gh.APIURL = originalEndpoint, originalAPIURL
+				p.ResetOAuthConfigCaches()
+			}()
+			gh.Endpoint.TokenURL = fakeGitHub.URL + "/token"
+			gh.APIURL = fakeGitHub.URL
+			p.ResetOAuthConfigCaches()
+
+			stateResponse := h.EmptyHTTPResponse(nil)
+			state := h.GenerateStateOauthCookie(stateResponse)
+
+			req, _ := http.NewRequest("GET", "http://example.local/auth/callback/github/third.example.local", nil)
+			req.Header.Add("Cookie", stateResponse.Header.Get("Set-Cookie"))
+			req.Form = url.Values{"state": {state}, "code": {"xxx"}}
+
+			resp, err := s.AuthRequestDecision(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+
+			bodyBytes, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(bodyBytes)).To(ContainSubstring("Wrong Account"))
+			Expect(string(bodyBytes)).To(ContainSubstring("not a member of an allowed organisation or team"))
+		})
+
 		It("should return a Google redirect when get '/auth/callback/google/{email}'", func() {
 			const (
 				path     = "/auth/callback/google/email.example.local"
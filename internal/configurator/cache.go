@@ -0,0 +1,164 @@
+package configurator
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// snapshot is a parsed config file, or why it couldn't be loaded, and the file's state
+// when it was read
+type snapshot struct {
+	config  Config
+	err     error
+	modTime time.Time
+	size    int64
+}
+
+func (s *snapshot) result() (Config, error) {
+	if s.err != nil {
+		return Config{}, s.err
+	}
+	return s.config, nil
+}
+
+// unchanged returns true if the file looks the same as when the snapshot was read
+func (s *snapshot) unchanged(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		// a file which still can't be found has nothing new to load
+		return s.err != nil && s.modTime.IsZero()
+	}
+	return info.ModTime().Equal(s.modTime) && info.Size() == s.size
+}
+
+var (
+	// snapshots holds the *snapshot for each config file path, the last good one or the
+	// failure if it's never loaded. They're swapped atomically so requests never see a
+	// partly loaded config
+	snapshots sync.Map
+
+	// loadMu stops the same file being loaded concurrently
+	loadMu sync.Mutex
+
+	reloadHooksMu sync.Mutex
+	reloadHooks   []func()
+)
+
+// OnReload calls f after a config file is reloaded, for dropping anything built from the
+// previous config
+func OnReload(f func()) {
+	reloadHooksMu.Lock()
+	defer reloadHooksMu.Unlock()
+	reloadHooks = append(reloadHooks, f)
+}
+
+func runReloadHooks() {
+	reloadHooksMu.Lock()
+	hooks := append([]func(){}, reloadHooks...)
+	reloadHooksMu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// loadSnapshot reads, parses and validates the config file, a file which can't be loaded
+// gives a snapshot of the error
+func loadSnapshot(filename string) *snapshot {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return &snapshot{err: err}
+	}
+
+	s := &snapshot{modTime: info.ModTime(), size: info.Size()}
+	// ReadConfigFile validates the config too
+	s.config, s.err = ReadConfigFile(filename)
+	return s
+}
+
+// LoadConfig returns the config file's parsed config, it's only read the first time and
+// when it's reloaded. A file which fails to load keeps returning the error until a reload
+// succeeds.
+func LoadConfig(filename string) (Config, error) {
+	if filename == "" {
+		return Config{}, errors.New("No config file")
+	}
+
+	if s, ok := snapshots.Load(filename); ok {
+		return s.(*snapshot).result()
+	}
+
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	if s, ok := snapshots.Load(filename); ok {
+		return s.(*snapshot).result()
+	}
+
+	s := loadSnapshot(filename)
+	snapshots.Store(filename, s)
+	return s.result()
+}
+
+// Reload re-reads the loaded config files, including those which failed to load, or only
+// those which have changed. A file which can't be read or doesn't validate is logged and
+// the last good config keeps being used.
+func Reload(changedOnly bool) error {
+	loadMu.Lock()
+	defer loadMu.Unlock()
+
+	var (
+		lastErr  error
+		reloaded bool
+	)
+	snapshots.Range(func(k, v interface{}) bool {
+		filename, current := k.(string), v.(*snapshot)
+
+		if changedOnly && current.unchanged(filename) {
+			return true
+		}
+
+		s := loadSnapshot(filename)
+		if s.err != nil {
+			lastErr = s.err
+			if current.err == nil {
+				log.Printf("Config reload of '%s' failed, keeping the last good config: %s", filename, s.err.Error())
+				return true
+			}
+
+			// there's no good config, so keep the new failure until the file changes again
+			log.Printf("Config reload of '%s' failed: %s", filename, s.err.Error())
+			snapshots.Store(filename, s)
+			return true
+		}
+
+		snapshots.Store(filename, s)
+		reloaded = true
+		log.Printf("Config reloaded from '%s'", filename)
+		return true
+	})
+
+	if reloaded {
+		runReloadHooks()
+	}
+
+	return lastErr
+}
+
+// Watch reloads changed config files every interval until stop is closed
+func Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			Reload(true)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package configurator_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/configurator"
+)
+
+var _ = Describe("Cache", func() {
+	var (
+		tempDir    string
+		configPath string
+	)
+
+	writeConfig := func(content string, modTime time.Time) {
+		Expect(ioutil.WriteFile(configPath, []byte(content), 0600)).To(Succeed())
+		Expect(os.Chtimes(configPath, modTime, modTime)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "cache")
+		Expect(err).NotTo(HaveOccurred())
+		configPath = filepath.Join(tempDir, "config.yml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("should only read the config file again when it's reloaded", func() {
+		writeConfig("domains:\n  - domain: one.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now().Add(-time.Hour))
+
+		dc, err := s.GetDomainConfig("one.local", configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.Domain).To(Equal("one.local"))
+
+		writeConfig("domains:\n  - domain: two.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now())
+
+		_, err = s.GetDomainConfig("one.local", configPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(s.Reload(true)).To(Succeed())
+
+		_, err = s.GetDomainConfig("one.local", configPath)
+		Expect(err).To(HaveOccurred())
+		dc, err = s.GetDomainConfig("two.local", configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.Domain).To(Equal("two.local"))
+	})
+
+	It("should keep the last good config when a reload fails", func() {
+		writeConfig("domains:\n  - domain: good.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now().Add(-time.Hour))
+
+		_, err := s.LoadConfig(configPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		writeConfig("domains: [", time.Now())
+		Expect(s.Reload(true)).NotTo(Succeed())
+
+		writeConfig("domains:\n  - domain: good.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n    upstream_url: /relative\n", time.Now().Add(time.Minute))
+		Expect(s.Reload(true)).NotTo(Succeed())
+
+		dc, err := s.GetDomainConfig("good.local", configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.Domain).To(Equal("good.local"))
+	})
+
+	It("should keep the error of a config file which fails to load and retry it on reload", func() {
+		writeConfig("domains:\n  - domain: retry.local\n    enabled: true\n    session_server_token: short\n", time.Now().Add(-time.Hour))
+
+		_, err := s.LoadConfig(configPath)
+		Expect(err).To(HaveOccurred())
+
+		writeConfig("domains:\n  - domain: retry.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now())
+
+		_, err = s.GetDomainConfig("retry.local", configPath)
+		Expect(err).To(HaveOccurred())
+
+		// other specs' files have been removed, so only this file's config is checked
+		s.Reload(true)
+
+		dc, err := s.GetDomainConfig("retry.local", configPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.Domain).To(Equal("retry.local"))
+	})
+
+	It("should reload changed config files with Watch", func() {
+		writeConfig("domains:\n  - domain: before.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now().Add(-time.Hour))
+
+		_, err := s.LoadConfig(configPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go s.Watch(10*time.Millisecond, stop)
+
+		writeConfig("domains:\n  - domain: after.local\n    enabled: true\n    session_server_token: 0123456789abcdef0123456789abcdef\n", time.Now())
+
+		Eventually(func() error {
+			_, err := s.GetDomainConfig("after.local", configPath)
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should not validate configs which can't be served", func() {
+		Expect(s.Config{DomainConfigs: []s.DomainConfig{
+			{Domain: "a.local", Enabled: true},
+			{Domain: "A.local", Enabled: true},
+		}}.Validate()).To(MatchError(ContainSubstring("more than once")))
+
+		Expect(s.Config{DomainConfigs: []s.DomainConfig{
+			{Domain: "a.local", Enabled: true, AccessRules: []s.AccessRule{{Regex: "("}}},
+		}}.Validate()).To(HaveOccurred())
+
+		Expect(s.Config{DomainConfigs: []s.DomainConfig{
+			{Enabled: true},
+		}}.Validate()).To(HaveOccurred())
+
+		// disabled domains aren't served
+		Expect(s.Config{DomainConfigs: []s.DomainConfig{
+			{Domain: "a.local", Enabled: true, SessionServerToken: "0123456789abcdef0123456789abcdef"},
+			{Domain: "a.local"},
+		}}.Validate()).To(Succeed())
+	})
+})
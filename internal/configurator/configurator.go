@@ -4,30 +4,97 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
-
-	"gopkg.in/yaml.v2"
+	"sync"
 )
 
-// LoginEmailDomain is a type which contains Google oauth settings
+// LoginEmailDomain is a type which contains oauth settings for an email domain and provider
 type LoginEmailDomain struct {
-	Domain            string `yaml:"domain"`
-	Provider          string `yaml:"provider"`
-	OAuthClientID     string `yaml:"oauth_client_id"`
-	OAuthClientSecret string `yaml:"oauth_client_secret"`
+	Domain              string   `yaml:"domain"`
+	Provider            string   `yaml:"provider"`
+	OAuthClientID       string   `yaml:"oauth_client_id"`
+	OAuthClientSecret   string   `yaml:"oauth_client_secret"`
+	Issuer              string   `yaml:"issuer"`
+	Scopes              []string `yaml:"scopes"`
+	GitHubOrganisations []string `yaml:"github_organisations"`
+	GitHubTeams         []string `yaml:"github_teams"`
+}
+
+// AccessAllow lists who is allowed by an AccessRule
+type AccessAllow struct {
+	Emails       []string `yaml:"emails"`
+	EmailDomains []string `yaml:"email_domains"`
+	Groups       []string `yaml:"groups"`
+}
+
+// AccessRule restricts matching requests to the users it allows, a rule matches a path
+// by prefix ("path"), by glob ("glob") or by regular expression ("regex")
+type AccessRule struct {
+	Path    string      `yaml:"path"`
+	Glob    string      `yaml:"glob"`
+	Regex   string      `yaml:"regex"`
+	Methods []string    `yaml:"methods"`
+	Allow   AccessAllow `yaml:"allow"`
+
+	regex *regexp.Regexp
+}
+
+// JWTKey is a PEM encoded RSA or ECDSA private key used to sign JWT assertions, the
+// algorithm defaults to RS256 for RSA keys and ES256/384/512 for ECDSA keys
+type JWTKey struct {
+	KeyID      string `yaml:"kid"`
+	Algorithm  string `yaml:"algorithm"`
+	PrivateKey string `yaml:"private_key"`
+}
+
+// JWTAssertion configures the signed JWT sent to the backend, the first key signs
+// and all of the keys are published so they can be rotated
+type JWTAssertion struct {
+	Header   string   `yaml:"header"`
+	Audience string   `yaml:"audience"`
+	TTL      int      `yaml:"ttl_seconds"`
+	Keys     []JWTKey `yaml:"keys"`
+}
+
+// Upstream restricts where requests for the domain can be forwarded. By default the
+// scheme can be http or https, the host must be the domain and any port is allowed.
+// RewriteURL optionally sends allowed requests to an internal address instead, the path,
+// query and Host header of the request are kept.
+type Upstream struct {
+	Schemes    []string `yaml:"schemes"`
+	Hosts      []string `yaml:"hosts"`
+	Ports      []int    `yaml:"ports"`
+	RewriteURL string   `yaml:"rewrite_url"`
 }
 
 // DomainConfig is the type which an entire site's config is within
 type DomainConfig struct {
-	Domain               string             `yaml:"domain"`
-	AuthPageTitle        string             `yaml:"auth_pages_title"`
-	Enabled              bool               `yaml:"enabled"`
-	LoginEmailDomains    []LoginEmailDomain `yaml:"login_email_domains"`
-	SessionCookieName    string             `yaml:"session_cookie_name"`
-	SessionServerToken   string             `yaml:"session_server_token"`
-	SecurityHeaders      map[string]string  `yaml:"security_headers"`
-	UnauthenticatedPaths []string           `yaml:"unauthenticated_paths"`
+	Domain                string             `yaml:"domain"`
+	AuthPageTitle         string             `yaml:"auth_pages_title"`
+	Enabled               bool               `yaml:"enabled"`
+	LoginEmailDomains     []LoginEmailDomain `yaml:"login_email_domains"`
+	SessionCookieName     string             `yaml:"session_cookie_name"`
+	SessionServerToken    string             `yaml:"session_server_token"`
+	SessionServerTokens   []string           `yaml:"session_server_tokens"`
+	SecurityHeaders       map[string]string  `yaml:"security_headers"`
+	IdentityHeaders       map[string]string  `yaml:"identity_headers"`
+	JWTAssertion          JWTAssertion       `yaml:"jwt_assertion"`
+	UnauthenticatedPaths  []string           `yaml:"unauthenticated_paths"`
+	AccessRules           []AccessRule       `yaml:"access_rules"`
+	Upstream              Upstream           `yaml:"upstream"`
+	MaxRequestBodyBytes   int64              `yaml:"max_request_body_bytes"`
+	CloseUpgradesAtExpiry bool               `yaml:"close_upgrades_at_session_expiry"`
+	StaticUpstreamURL     string             `yaml:"upstream_url"`
+	Aliases               []string           `yaml:"aliases"`
+	ShareSessionCookie    bool               `yaml:"share_session_cookie"`
+
+	// MatchedDomain is the domain, alias or wildcard pattern which matched the hostname
+	MatchedDomain string `yaml:"-"`
 }
 
 // Config is the master configuration type, it has an array of DomainConfig objects
@@ -35,46 +102,105 @@ type Config struct {
 	DomainConfigs []DomainConfig `yaml:"domains"`
 }
 
-// ReadConfigFile takes a yaml filename, attempts to parse and returns Config object
+// ReadConfigFile takes a yaml filename, attempts to parse and validate and returns Config object
 func ReadConfigFile(filename string) (Config, error) {
-	var c Config
-
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		//fmt.Printf("ReadConfigFile: Couldn't read: '%s'\n", filename)
-		return c, err
+		return Config{}, err
 	}
 
-	err = yaml.Unmarshal(data, &c)
-	if err != nil {
-		return c, err
-	}
-
-	return c, nil
+	return ParseConfig(data)
 }
 
 // GetDomainConfigFromRequest returns DomainConfig (and error) from a request and DOMAIN_CONFIG_FILEPATH env var
 func GetDomainConfigFromRequest(request *http.Request) (DomainConfig, error) {
 	hsn := request.URL.Hostname()
+	//fmt.Printf("hsn: %s\n", hsn)
+	return GetDomainConfig(hsn, FilePath())
+}
+
+// FilePath returns the config file path from DOMAIN_CONFIG_FILEPATH, or the default
+func FilePath() string {
 	dcf := os.Getenv("DOMAIN_CONFIG_FILEPATH")
 	if dcf == "" {
 		dcf = "config/default.yml"
 	}
-	//fmt.Printf("hsn: %s\n", hsn)
-	//fmt.Printf("dcf: %s\n", dcf)
-	return GetDomainConfig(hsn, dcf)
+	return dcf
 }
 
-// Get returns the DomainConfig for a specific domain
+// Get returns the DomainConfig for a specific domain, exact matches of a domain or alias take
+// precedence over wildcards. When an alias or wildcard matches, Domain is set to the hostname.
 func (c Config) Get(domain string) DomainConfig {
-	var dc DomainConfig
 	for _, d := range c.DomainConfigs {
-		if strings.ToLower(domain) == strings.ToLower(d.Domain) && d.Enabled {
-			dc = d
-			break
+		if !d.Enabled {
+			continue
+		}
+		for _, name := range d.names() {
+			if !isWildcard(name) && strings.EqualFold(name, domain) {
+				return d.matched(domain, name)
+			}
+		}
+	}
+
+	for _, d := range c.DomainConfigs {
+		if !d.Enabled {
+			continue
 		}
+		for _, name := range d.names() {
+			if matchesWildcard(name, domain) {
+				return d.matched(domain, name)
+			}
+		}
+	}
+
+	return DomainConfig{}
+}
+
+// names returns the domain and its aliases
+func (c DomainConfig) names() []string {
+	return append([]string{c.Domain}, c.Aliases...)
+}
+
+func (c DomainConfig) matched(hostname string, name string) DomainConfig {
+	if name != c.Domain || isWildcard(name) {
+		c.Domain = strings.ToLower(hostname)
+	}
+	c.MatchedDomain = name
+	return c
+}
+
+func isWildcard(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// matchesWildcard returns true if the hostname is one label below a "*." pattern, like
+// certificates "*.example.com" matches "a.example.com" but not "a.b.example.com"
+func matchesWildcard(pattern string, hostname string) bool {
+	if !isWildcard(pattern) || strings.Contains(hostname, "*") {
+		return false
+	}
+	n := strings.Index(hostname, ".")
+	return n > 0 && strings.EqualFold(hostname[n+1:], pattern[2:])
+}
+
+// ConfiguredDomain returns the domain, alias or wildcard pattern from the config which
+// matched, for anything shared by all of its hostnames
+func (c DomainConfig) ConfiguredDomain() string {
+	if c.MatchedDomain != "" {
+		return c.MatchedDomain
+	}
+	return c.Domain
+}
+
+// SessionCookieDomain returns the Domain attribute for session cookies. It is empty, so
+// cookies are only sent to the hostname, unless share_session_cookie is set and a
+// wildcard matched, when one session is shared by every host under the wildcard.
+func (c DomainConfig) SessionCookieDomain() string {
+	if c.ShareSessionCookie && isWildcard(c.MatchedDomain) {
+		return c.MatchedDomain[2:]
 	}
-	return dc
+	return ""
 }
 
 // GetLoginEmailDomain returns the GoogleEmailDomain for a specific domain out of DomainConfig
@@ -104,7 +230,11 @@ func (c DomainConfig) GetLoginProviders(domain string) []string {
 func GetDomainConfig(domain string, filename string) (DomainConfig, error) {
 	var err error
 
-	c, err := ReadConfigFile(filename)
+	if dc, ok := registered(domain); ok {
+		return dc, nil
+	}
+
+	c, err := LoadConfig(filename)
 	if err != nil {
 		//fmt.Printf("GetDomainConfig: Couldn't find '%s' in '%s'\n", domain, filename)
 		return DomainConfig{}, err
@@ -119,7 +249,62 @@ func GetDomainConfig(domain string, filename string) (DomainConfig, error) {
 	return dc, nil
 }
 
-// IsUnauthPath will return true if the request domain config matches and authenticated path
+var (
+	registeredMu      sync.RWMutex
+	registeredDomains = map[string]DomainConfig{}
+)
+
+// Register adds a domain config which is used instead of the config file's, for when the
+// service is embedded in another application
+func Register(dc DomainConfig) {
+	dc.compileAccessRules()
+
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	registeredDomains[strings.ToLower(dc.Domain)] = dc
+}
+
+// Unregister removes a domain config added by Register
+func Unregister(domain string) {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	delete(registeredDomains, strings.ToLower(domain))
+}
+
+func registered(domain string) (DomainConfig, bool) {
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+	dc, ok := registeredDomains[strings.ToLower(domain)]
+	return dc, ok && dc.Enabled
+}
+
+// GetSessionServerTokens returns the session keys, newest first. The first is used to
+// encrypt cookies and all of them are used to decrypt, "session_server_tokens" takes
+// precedence over the single "session_server_token". Empty tokens are left out, so a
+// domain without a token has no keys rather than one derived from "".
+func (c DomainConfig) GetSessionServerTokens() []string {
+	tokens := c.SessionServerTokens
+	if len(tokens) == 0 {
+		tokens = []string{c.SessionServerToken}
+	}
+
+	var res []string
+	for _, token := range tokens {
+		if token != "" {
+			res = append(res, token)
+		}
+	}
+	return res
+}
+
+// CleanPath returns the decoded request path the upstream sees, so "/%61dmin" and
+// "/x/../admin" are both "/admin"
+func CleanPath(u *url.URL) string {
+	return path.Clean("/" + u.Path)
+}
+
+// IsUnauthPath will return true if the request domain config matches and authenticated path,
+// unauthenticated paths match whole path segments of the cleaned path
 func IsUnauthPath(request *http.Request) bool {
 	res := false
 
@@ -128,8 +313,10 @@ func IsUnauthPath(request *http.Request) bool {
 		return res
 	}
 
+	reqPath := CleanPath(request.URL)
 	for _, uap := range dc.UnauthenticatedPaths {
-		if strings.HasPrefix(request.URL.EscapedPath(), uap) {
+		prefix := strings.TrimSuffix(uap, "/")
+		if reqPath == prefix || strings.HasPrefix(reqPath, prefix+"/") {
 			res = true
 			break
 		}
@@ -137,3 +324,193 @@ func IsUnauthPath(request *http.Request) bool {
 
 	return res
 }
+
+// compileAccessRules compiles access rule regexes once, instead of for every request
+func (c *DomainConfig) compileAccessRules() {
+	for n := range c.AccessRules {
+		r := &c.AccessRules[n]
+		if r.Regex != "" {
+			r.regex, _ = regexp.Compile(r.Regex)
+		}
+	}
+}
+
+// Matches returns true if the rule applies to the method and path, a rule with a
+// regex that doesn't compile matches everything so that it fails closed
+func (r AccessRule) Matches(method string, reqPath string) bool {
+	if len(r.Methods) > 0 {
+		methodOK := false
+		for _, m := range r.Methods {
+			if strings.ToUpper(m) == strings.ToUpper(method) {
+				methodOK = true
+				break
+			}
+		}
+		if !methodOK {
+			return false
+		}
+	}
+
+	if r.Path != "" && !strings.HasPrefix(reqPath, r.Path) {
+		return false
+	}
+
+	if r.Glob != "" {
+		if ok, err := path.Match(r.Glob, reqPath); err == nil && !ok {
+			return false
+		}
+	}
+
+	if r.Regex != "" {
+		re := r.regex
+		if re == nil {
+			// rules which weren't loaded from a config or registered
+			re, _ = regexp.Compile(r.Regex)
+		}
+		if re != nil && !re.MatchString(reqPath) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Allows returns true if the email address or one of the groups is allowed by the rule
+func (r AccessRule) Allows(email string, groups []string) bool {
+	email = strings.ToLower(email)
+
+	for _, e := range r.Allow.Emails {
+		if email != "" && strings.ToLower(e) == email {
+			return true
+		}
+	}
+
+	if strings.Contains(email, "@") {
+		se := strings.Split(email, "@")
+		domain := se[len(se)-1]
+		for _, d := range r.Allow.EmailDomains {
+			if strings.ToLower(d) == domain {
+				return true
+			}
+		}
+	}
+
+	for _, ag := range r.Allow.Groups {
+		for _, g := range groups {
+			if strings.ToLower(ag) == strings.ToLower(g) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// GetAccessRule returns the first access rule which matches the method and path
+func (c DomainConfig) GetAccessRule(method string, reqPath string) (AccessRule, bool) {
+	for _, r := range c.AccessRules {
+		if r.Matches(method, reqPath) {
+			return r, true
+		}
+	}
+	return AccessRule{}, false
+}
+
+// AllowsUpstream returns true if requests for the domain can be forwarded to the URL
+func (c DomainConfig) AllowsUpstream(u *url.URL) bool {
+	if c.Domain == "" || u == nil {
+		return false
+	}
+
+	schemes := c.Upstream.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsFold(schemes, u.Scheme) {
+		return false
+	}
+
+	hosts := c.Upstream.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{c.Domain}
+	}
+	if !containsFold(hosts, u.Hostname()) {
+		return false
+	}
+
+	if len(c.Upstream.Ports) > 0 {
+		port := u.Port()
+		if port == "" {
+			port = defaultPort(u.Scheme)
+		}
+		found := false
+		for _, p := range c.Upstream.Ports {
+			if strconv.Itoa(p) == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if c.rewriteURL() != "" {
+		if _, err := c.UpstreamURL(u); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// rewriteURL returns the upstream's rewrite_url, falling back to the static upstream_url
+func (c DomainConfig) rewriteURL() string {
+	if c.Upstream.RewriteURL != "" {
+		return c.Upstream.RewriteURL
+	}
+	return c.StaticUpstreamURL
+}
+
+// UpstreamURL returns the URL to forward to, which is the URL unless RewriteURL or
+// StaticUpstreamURL is set
+func (c DomainConfig) UpstreamURL(u *url.URL) (*url.URL, error) {
+	res := *u
+	if c.rewriteURL() == "" {
+		return &res, nil
+	}
+
+	rw, err := url.Parse(c.rewriteURL())
+	if err != nil {
+		return nil, err
+	}
+	if rw.Scheme == "" || rw.Host == "" {
+		return nil, errors.New("rewrite_url and upstream_url must be absolute URLs")
+	}
+
+	res.Scheme = rw.Scheme
+	res.Host = rw.Host
+	if strings.TrimSuffix(rw.Path, "/") != "" {
+		res.Path = strings.TrimSuffix(rw.Path, "/") + u.Path
+		if u.RawPath != "" {
+			res.RawPath = strings.TrimSuffix(rw.EscapedPath(), "/") + u.RawPath
+		}
+	}
+	return &res, nil
+}
+
+func defaultPort(scheme string) string {
+	if strings.ToLower(scheme) == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.ToLower(v) == strings.ToLower(s) {
+			return true
+		}
+	}
+	return false
+}
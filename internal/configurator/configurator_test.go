@@ -3,12 +3,13 @@ package configurator_test
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	s "authenticating-route-service/internal/configurator"
+	s "github.com/OllieJC/authenticating-route-service/internal/configurator"
 )
 
 var _ = Describe("configurator", func() {
@@ -17,8 +18,8 @@ var _ = Describe("configurator", func() {
 		c, err := s.ReadConfigFile("../../test/data/example.yml")
 		Expect(err).ToNot(HaveOccurred())
 
-		// example.yml has two entries
-		Expect(len(c.DomainConfigs)).To(BeEquivalentTo(2))
+		// example.yml has five entries
+		Expect(len(c.DomainConfigs)).To(BeEquivalentTo(5))
 
 		// first item domain
 		Expect(c.DomainConfigs[0].Domain).To(Equal("example.local"))
@@ -28,6 +29,13 @@ var _ = Describe("configurator", func() {
 
 		Expect(c.DomainConfigs[0].LoginEmailDomains[0].Provider).To(Equal("google"))
 
+		Expect(c.DomainConfigs[0].IdentityHeaders).To(HaveKeyWithValue("groups", "X-Auth-Teams"))
+
+		Expect(c.DomainConfigs[0].GetSessionServerTokens()).To(Equal([]string{"GHI123-0123456789abcdef0123456789abcdef", "DEF890-0123456789abcdef0123456789abcdef"}))
+		Expect(s.DomainConfig{SessionServerToken: "ABC"}.GetSessionServerTokens()).To(Equal([]string{"ABC"}))
+		Expect(s.DomainConfig{}.GetSessionServerTokens()).To(BeEmpty())
+		Expect(s.DomainConfig{SessionServerTokens: []string{""}}.GetSessionServerTokens()).To(BeEmpty())
+
 		printme := false
 		if printme {
 			for _, d := range c.DomainConfigs {
@@ -74,6 +82,25 @@ var _ = Describe("configurator", func() {
 		Expect(dc.Domain).Should(Equal("example.local"))
 	})
 
+	It("should return registered domains from GetDomainConfig without a config file", func() {
+		defer s.Unregister("registered.example.local")
+		defer s.Unregister("disabled.example.local")
+
+		s.Register(s.DomainConfig{Domain: "Registered.example.local", Enabled: true, SessionCookieName: "REG"})
+
+		dc, err := s.GetDomainConfig("registered.example.local", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dc.SessionCookieName).Should(Equal("REG"))
+
+		s.Register(s.DomainConfig{Domain: "disabled.example.local"})
+		_, err = s.GetDomainConfig("disabled.example.local", "")
+		Expect(err).To(HaveOccurred())
+
+		s.Unregister("Registered.example.local")
+		_, err = s.GetDomainConfig("registered.example.local", "")
+		Expect(err).To(HaveOccurred())
+	})
+
 	It("should not return an object from GetDomainConfig if enabled is not set", func() {
 		var err error
 
@@ -99,8 +126,53 @@ var _ = Describe("configurator", func() {
 		dc, err := s.GetDomainConfig("example.local", "../../test/data/example.yml")
 		Expect(err).ToNot(HaveOccurred())
 
-		ged := dc.GetLoginEmailDomain("second.example.local", "None")
-		Expect(ged.Provider).To(Equal("none"))
+		ged := dc.GetLoginEmailDomain("second.example.local", "OIDC")
+		Expect(ged.Provider).To(Equal("oidc"))
+	})
+
+	It("should match wildcard domains and aliases, preferring exact matches", func() {
+		c := s.Config{DomainConfigs: []s.DomainConfig{
+			{Domain: "*.apps.example.local", Enabled: true, SessionCookieName: "WILDCARD", ShareSessionCookie: true},
+			{Domain: "main.example.local", Aliases: []string{"www.example.local", "*.www.example.local"}, Enabled: true, SessionCookieName: "MAIN"},
+			{Domain: "pr-1.apps.example.local", Enabled: true, SessionCookieName: "EXACT"},
+			{Domain: "*.disabled.example.local", SessionCookieName: "DISABLED"},
+		}}
+
+		dc := c.Get("PR-123.apps.example.local")
+		Expect(dc.SessionCookieName).To(Equal("WILDCARD"))
+		Expect(dc.Domain).To(Equal("pr-123.apps.example.local"))
+		Expect(dc.MatchedDomain).To(Equal("*.apps.example.local"))
+		Expect(dc.ConfiguredDomain()).To(Equal("*.apps.example.local"))
+		Expect(dc.SessionCookieDomain()).To(Equal("apps.example.local"))
+
+		dc = c.Get("pr-1.apps.example.local")
+		Expect(dc.SessionCookieName).To(Equal("EXACT"))
+		Expect(dc.MatchedDomain).To(Equal("pr-1.apps.example.local"))
+		Expect(dc.SessionCookieDomain()).To(Equal(""))
+
+		dc = c.Get("www.example.local")
+		Expect(dc.SessionCookieName).To(Equal("MAIN"))
+		Expect(dc.Domain).To(Equal("www.example.local"))
+		Expect(dc.MatchedDomain).To(Equal("www.example.local"))
+
+		Expect(c.Get("a.www.example.local").SessionCookieName).To(Equal("MAIN"))
+		Expect(c.Get("main.example.local").Domain).To(Equal("main.example.local"))
+
+		// wildcards only match one label
+		Expect(c.Get("a.b.apps.example.local").Enabled).To(BeFalse())
+		Expect(c.Get("apps.example.local").Enabled).To(BeFalse())
+		Expect(c.Get("*.apps.example.local").Enabled).To(BeFalse())
+		Expect(c.Get("a.disabled.example.local").Enabled).To(BeFalse())
+	})
+
+	It("should return wildcard domains from the config file", func() {
+		dc, err := s.GetDomainConfig("pr-9.preview.example.local", "../../test/data/example.yml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.SessionCookieName).To(Equal("PREVIEW"))
+
+		dc, err = s.GetDomainConfig("preview.example.local", "../../test/data/example.yml")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(dc.SessionCookieDomain()).To(Equal(""))
 	})
 
 	It("should return correct LoginEmailDomain from DomainConfig", func() {
@@ -135,6 +207,18 @@ var _ = Describe("configurator", func() {
 		Expect(res).To(BeFalse())
 	})
 
+	It("should only match whole segments of the cleaned path as unauthenticated", func() {
+		for _, target := range []string{"/test/unauth/page", "/test/unauth/", "/x/../test/unauth", "/test/%75nauth"} {
+			request, _ := http.NewRequest("GET", "http://example.local"+target, nil)
+			Expect(s.IsUnauthPath(request)).To(BeTrue(), target)
+		}
+
+		for _, target := range []string{"/test/unauth/../admin", "/test/unauth/%2e%2e/admin", "/test/unauthorised", "/test/unauth/%2E%2E/%2e%2e/admin"} {
+			request, _ := http.NewRequest("GET", "http://example.local"+target, nil)
+			Expect(s.IsUnauthPath(request)).To(BeFalse(), target)
+		}
+	})
+
 	It("should return false when visitng bad host", func() {
 		request, _ := http.NewRequest("GET", "http://not-valid.local/test/unauth", nil)
 
@@ -142,4 +226,127 @@ var _ = Describe("configurator", func() {
 
 		Expect(res).To(BeFalse())
 	})
+
+	It("should return the first matching access rule with GetAccessRule", func() {
+		dc, err := s.GetDomainConfig("example.local", "../../test/data/example.yml")
+		Expect(err).ToNot(HaveOccurred())
+
+		rule, found := dc.GetAccessRule("GET", "/admin/users")
+		Expect(found).To(BeTrue())
+		Expect(rule.Path).To(Equal("/admin"))
+
+		_, found = dc.GetAccessRule("DELETE", "/admin/users")
+		Expect(found).To(BeFalse())
+
+		rule, found = dc.GetAccessRule("GET", "/reports/2019/summary")
+		Expect(found).To(BeTrue())
+		Expect(rule.Glob).To(Equal("/reports/*/summary"))
+
+		_, found = dc.GetAccessRule("GET", "/reports/2019/detail")
+		Expect(found).To(BeFalse())
+
+		rule, found = dc.GetAccessRule("PUT", "/private/123")
+		Expect(found).To(BeTrue())
+		Expect(rule.Regex).To(Equal("^/private/[0-9]+$"))
+
+		_, found = dc.GetAccessRule("GET", "/private/abc")
+		Expect(found).To(BeFalse())
+	})
+
+	It("should allow emails, email domains and groups with Allows", func() {
+		rule := s.AccessRule{Allow: s.AccessAllow{
+			Emails:       []string{"Admin@Example.local"},
+			EmailDomains: []string{"staff.example.local"},
+			Groups:       []string{"admins"},
+		}}
+
+		Expect(rule.Allows("admin@example.local", nil)).To(BeTrue())
+		Expect(rule.Allows("someone@staff.example.local", nil)).To(BeTrue())
+		Expect(rule.Allows("someone@example.local", []string{"devs", "Admins"})).To(BeTrue())
+		Expect(rule.Allows("someone@example.local", []string{"devs"})).To(BeFalse())
+		Expect(rule.Allows("", nil)).To(BeFalse())
+	})
+
+	It("should fail closed when an access rule regex is invalid", func() {
+		rule := s.AccessRule{Regex: "^/(unclosed"}
+
+		Expect(rule.Matches("GET", "/anything")).To(BeTrue())
+		Expect(rule.Allows("someone@example.local", nil)).To(BeFalse())
+	})
+
+	Context("Upstream", func() {
+		mustParse := func(raw string) *url.URL {
+			u, err := url.Parse(raw)
+			Expect(err).NotTo(HaveOccurred())
+			return u
+		}
+
+		It("should only allow the domain itself by default", func() {
+			dc := s.DomainConfig{Domain: "example.local"}
+
+			Expect(dc.AllowsUpstream(mustParse("https://example.local/path"))).To(BeTrue())
+			Expect(dc.AllowsUpstream(mustParse("http://EXAMPLE.local:8080/path"))).To(BeTrue())
+			Expect(dc.AllowsUpstream(mustParse("https://evil.local/path"))).To(BeFalse())
+			Expect(dc.AllowsUpstream(mustParse("ftp://example.local/path"))).To(BeFalse())
+			Expect(s.DomainConfig{}.AllowsUpstream(mustParse("https://example.local/"))).To(BeFalse())
+		})
+
+		It("should allow the configured schemes, hosts and ports", func() {
+			dc := s.DomainConfig{
+				Domain: "example.local",
+				Upstream: s.Upstream{
+					Schemes: []string{"https"},
+					Hosts:   []string{"example.local", "app.example.local"},
+					Ports:   []int{443, 8443},
+				},
+			}
+
+			Expect(dc.AllowsUpstream(mustParse("https://app.example.local/path"))).To(BeTrue())
+			Expect(dc.AllowsUpstream(mustParse("https://example.local:8443/path"))).To(BeTrue())
+			Expect(dc.AllowsUpstream(mustParse("http://example.local/path"))).To(BeFalse())
+			Expect(dc.AllowsUpstream(mustParse("https://example.local:8080/path"))).To(BeFalse())
+			Expect(dc.AllowsUpstream(mustParse("https://other.example.local/path"))).To(BeFalse())
+		})
+
+		It("should rewrite the upstream URL to the internal address", func() {
+			dc := s.DomainConfig{
+				Domain:   "example.local",
+				Upstream: s.Upstream{RewriteURL: "http://10.0.0.5:8080/app/"},
+			}
+
+			u, err := dc.UpstreamURL(mustParse("https://example.local/some%2Fpath?q=1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.String()).To(Equal("http://10.0.0.5:8080/app/some%2Fpath?q=1"))
+
+			dc.Upstream.RewriteURL = "http://10.0.0.5:8080"
+			u, err = dc.UpstreamURL(mustParse("https://example.local/path?q=1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.String()).To(Equal("http://10.0.0.5:8080/path?q=1"))
+		})
+
+		It("should forward to the static upstream_url when there's no rewrite URL", func() {
+			dc := s.DomainConfig{
+				Domain:            "example.local",
+				StaticUpstreamURL: "http://10.0.0.6:8080",
+			}
+
+			u, err := dc.UpstreamURL(mustParse("https://example.local/path?q=1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.String()).To(Equal("http://10.0.0.6:8080/path?q=1"))
+
+			dc.Upstream.RewriteURL = "http://10.0.0.5:8080"
+			u, err = dc.UpstreamURL(mustParse("https://example.local/path?q=1"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(u.String()).To(Equal("http://10.0.0.5:8080/path?q=1"))
+		})
+
+		It("should not allow any upstream with an invalid rewrite URL", func() {
+			dc := s.DomainConfig{
+				Domain:   "example.local",
+				Upstream: s.Upstream{RewriteURL: "/relative"},
+			}
+
+			Expect(dc.AllowsUpstream(mustParse("https://example.local/path"))).To(BeFalse())
+		})
+	})
 })
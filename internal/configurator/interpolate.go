@@ -0,0 +1,86 @@
+package configurator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+	"gopkg.in/yaml.v3"
+)
+
+// referenceRegexp matches ${ENV:NAME} and ${FILE:/path} in config values
+var referenceRegexp = regexp.MustCompile(`\$\{(ENV|FILE):([^}]*)\}`)
+
+// resolveReference returns the value of an environment variable or the contents of a
+// file, without trailing new lines
+func resolveReference(kind string, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("${%s:} needs a name", kind)
+	}
+
+	switch kind {
+	case "ENV":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	default:
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("can't read %s: %s", name, err.Error())
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+}
+
+// interpolate replaces references in the string values of the node and its children,
+// resolved values are redacted from debug output as they're usually secrets
+func interpolate(node *yaml.Node, path string) (changed bool, problems []Problem) {
+	child := func(n *yaml.Node, p string) {
+		c, ps := interpolate(n, p)
+		changed = changed || c
+		problems = append(problems, ps...)
+	}
+
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			child(n, path)
+		}
+	case yaml.MappingNode:
+		// only values are interpolated, not keys
+		for n := 0; n+1 < len(node.Content); n += 2 {
+			key := node.Content[n].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			child(node.Content[n+1], key)
+		}
+	case yaml.SequenceNode:
+		for n, item := range node.Content {
+			child(item, fmt.Sprintf("%s[%d]", path, n))
+		}
+	case yaml.ScalarNode:
+		if node.Tag != "!!str" || !referenceRegexp.MatchString(node.Value) {
+			break
+		}
+
+		node.Value = referenceRegexp.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			m := referenceRegexp.FindStringSubmatch(ref)
+			value, err := resolveReference(m[1], m[2])
+			if err != nil {
+				problems = append(problems, Problem{Line: node.Line, Path: path, Message: err.Error()})
+				return ""
+			}
+			Redact(value)
+			return value
+		})
+		changed = true
+	}
+
+	return changed, problems
+}
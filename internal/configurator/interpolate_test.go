@@ -0,0 +1,77 @@
+package configurator_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+)
+
+var _ = Describe("Interpolate", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "interpolate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+		os.Unsetenv("INTERPOLATE_CLIENT_SECRET")
+		os.Unsetenv("DEBUG")
+	})
+
+	It("should resolve environment variable and file references", func() {
+		os.Setenv("INTERPOLATE_CLIENT_SECRET", "client-secret-from-env")
+
+		tokenPath := filepath.Join(tempDir, "session_key")
+		Expect(ioutil.WriteFile(tokenPath, []byte("0123456789abcdef0123456789abcdef\n"), 0600)).To(Succeed())
+
+		c, err := s.ParseConfig([]byte(`domains:
+  - domain: example.local
+    enabled: true
+    session_server_token: "${FILE:` + tokenPath + `}"
+    login_email_domains:
+      - domain: email.example.local
+        provider: google
+        oauth_client_id: abc
+        oauth_client_secret: prefix-${ENV:INTERPOLATE_CLIENT_SECRET}
+    identity_headers:
+      "${ENV:INTERPOLATE_CLIENT_SECRET}": "X-Keys-Are-Not-Interpolated"
+`))
+		Expect(err).NotTo(HaveOccurred())
+
+		dc := c.DomainConfigs[0]
+		Expect(dc.SessionServerToken).To(Equal("0123456789abcdef0123456789abcdef"))
+		Expect(dc.LoginEmailDomains[0].OAuthClientSecret).To(Equal("prefix-client-secret-from-env"))
+		Expect(dc.IdentityHeaders).To(HaveKey("${ENV:INTERPOLATE_CLIENT_SECRET}"))
+
+		os.Setenv("DEBUG", "true")
+		Expect(Debugfln("secret: %s", dc.LoginEmailDomains[0].OAuthClientSecret)).To(Equal("secret: prefix-[REDACTED]"))
+		Expect(Debugfln("token: %s", dc.SessionServerToken)).To(Equal("token: [REDACTED]"))
+	})
+
+	It("should report references which can't be resolved", func() {
+		_, err := s.ParseConfig([]byte(`domains:
+  - domain: example.local
+    session_server_token: "${ENV:INTERPOLATE_NOT_SET}"
+    auth_pages_title: "${FILE:/does/not/exist}"
+    session_cookie_name: "${ENV:}"
+`))
+		Expect(err).To(HaveOccurred())
+
+		verr, ok := err.(*s.ValidationError)
+		Expect(ok).To(BeTrue())
+		Expect(verr.Problems).To(HaveLen(3))
+		Expect(verr.Problems[0]).To(Equal(s.Problem{Line: 3, Path: "domains[0].session_server_token", Message: "environment variable INTERPOLATE_NOT_SET is not set"}))
+		Expect(verr.Problems[1].Line).To(Equal(4))
+		Expect(verr.Problems[1].Message).To(HavePrefix("can't read /does/not/exist"))
+		Expect(verr.Problems[2]).To(Equal(s.Problem{Line: 5, Path: "domains[0].session_cookie_name", Message: "${ENV:} needs a name"}))
+	})
+})
@@ -0,0 +1,158 @@
+package configurator
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+	"github.com/cloudfoundry-community/go-cfenv"
+	"gopkg.in/yaml.v3"
+)
+
+const userProvidedLabel = "user-provided"
+
+// secretFields are the credential keys whose values are redacted from debug output
+var secretFields = map[string]bool{
+	"session_server_token":  true,
+	"session_server_tokens": true,
+	"oauth_client_secret":   true,
+	"private_key":           true,
+}
+
+// redactSecretFields stops the secrets in the credentials being printed by Debugfln
+func redactSecretFields(v interface{}, secret bool) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, item := range value {
+			redactSecretFields(item, secretFields[k])
+		}
+	case []interface{}:
+		for _, item := range value {
+			redactSecretFields(item, secret)
+		}
+	case string:
+		if secret {
+			Redact(value)
+		}
+	}
+}
+
+// serviceDomains returns the domains in the credentials of user-provided services bound to
+// the app, which have the same fields as the domains in the config file
+func serviceDomains() ([]map[string]interface{}, error) {
+	if !cfenv.IsRunningOnCF() || os.Getenv("VCAP_SERVICES") == "" {
+		return nil, nil
+	}
+
+	app, err := cfenv.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	services, err := app.Services.WithLabel(userProvidedLabel)
+	if err != nil {
+		// no user-provided services are bound
+		return nil, nil
+	}
+
+	var domains []map[string]interface{}
+	for _, service := range services {
+		raw, ok := service.Credentials["domains"]
+		if !ok {
+			continue
+		}
+
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: domains must be a list", service.Name)
+		}
+		for n, item := range list {
+			domain, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: domains[%d] must be an object", service.Name, n)
+			}
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains, nil
+}
+
+// mergeServices overrides the config with the domains from VCAP_SERVICES, only the fields
+// set are changed and login_email_domains are matched by domain and provider. Domains which
+// aren't in the config file are added
+func (c *Config) mergeServices() error {
+	domains, err := serviceDomains()
+	if err != nil {
+		return err
+	}
+
+	for _, fields := range domains {
+		redactSecretFields(fields, false)
+
+		name, _ := fields["domain"].(string)
+
+		var dc *DomainConfig
+		for n := range c.DomainConfigs {
+			if strings.EqualFold(c.DomainConfigs[n].Domain, name) {
+				dc = &c.DomainConfigs[n]
+				break
+			}
+		}
+		if dc == nil {
+			c.DomainConfigs = append(c.DomainConfigs, DomainConfig{})
+			dc = &c.DomainConfigs[len(c.DomainConfigs)-1]
+		}
+
+		// decoding a list replaces it, so login_email_domains are merged one at a time
+		others := map[string]interface{}{}
+		for k, v := range fields {
+			if k != "login_email_domains" {
+				others[k] = v
+			}
+		}
+		if err := decodeStrict(others, dc); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+
+		leds, _ := fields["login_email_domains"].([]interface{})
+		for _, item := range leds {
+			led, _ := item.(map[string]interface{})
+			ledDomain, _ := led["domain"].(string)
+			ledProvider, _ := led["provider"].(string)
+
+			var target *LoginEmailDomain
+			for n := range dc.LoginEmailDomains {
+				existing := &dc.LoginEmailDomains[n]
+				if strings.EqualFold(existing.Domain, ledDomain) && strings.EqualFold(existing.Provider, ledProvider) {
+					target = existing
+					break
+				}
+			}
+			if target == nil {
+				dc.LoginEmailDomains = append(dc.LoginEmailDomains, LoginEmailDomain{})
+				target = &dc.LoginEmailDomains[len(dc.LoginEmailDomains)-1]
+			}
+
+			if err := decodeStrict(led, target); err != nil {
+				return fmt.Errorf("%s: login_email_domains: %s", name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// decodeStrict sets the fields of out from v, failing on unknown keys like the config file
+func decodeStrict(v interface{}, out interface{}) error {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
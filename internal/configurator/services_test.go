@@ -0,0 +1,95 @@
+package configurator_test
+
+import (
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+)
+
+var _ = Describe("Services", func() {
+	const config = `domains:
+  - domain: example.local
+    enabled: true
+    login_email_domains:
+      - domain: email.example.local
+        provider: google
+        oauth_client_id: abc
+    security_headers:
+      x-frame-options: DENY
+`
+
+	BeforeEach(func() {
+		os.Setenv("VCAP_APPLICATION", "{}")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Unsetenv("VCAP_SERVICES")
+	})
+
+	It("should merge domains from user-provided services over the config file", func() {
+		os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "auth-secrets", "label": "user-provided", "credentials": {"domains": [
+			{"domain": "Example.local", "session_server_token": "0123456789abcdef0123456789abcdef",
+			 "security_headers": {"referrer-policy": "no-referrer"},
+			 "login_email_domains": [
+				{"domain": "email.example.local", "provider": "google", "oauth_client_secret": "from-env"},
+				{"domain": "other.example.local", "provider": "github", "oauth_client_id": "ghi", "oauth_client_secret": "456", "github_organisations": ["example-org"]}
+			 ]},
+			{"domain": "env.local", "enabled": true, "session_server_token": "fedcba9876543210fedcba9876543210", "max_request_body_bytes": 2048}
+		]}}]}`)
+
+		c, err := s.ParseConfig([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.DomainConfigs).To(HaveLen(2))
+
+		dc := c.DomainConfigs[0]
+		Expect(dc.Domain).To(Equal("Example.local"))
+		Expect(dc.Enabled).To(BeTrue())
+		Expect(dc.SessionServerToken).To(Equal("0123456789abcdef0123456789abcdef"))
+		Expect(dc.SecurityHeaders).To(Equal(map[string]string{"x-frame-options": "DENY", "referrer-policy": "no-referrer"}))
+		Expect(dc.LoginEmailDomains).To(HaveLen(2))
+		Expect(dc.LoginEmailDomains[0].OAuthClientID).To(Equal("abc"))
+		Expect(dc.LoginEmailDomains[0].OAuthClientSecret).To(Equal("from-env"))
+		Expect(dc.LoginEmailDomains[1].Provider).To(Equal("github"))
+
+		Expect(c.DomainConfigs[1].Domain).To(Equal("env.local"))
+		Expect(c.DomainConfigs[1].MaxRequestBodyBytes).To(Equal(int64(2048)))
+
+		os.Setenv("DEBUG", "true")
+		defer os.Unsetenv("DEBUG")
+		Expect(Debugfln("%s %s %s", dc.Domain, dc.SessionServerToken, dc.LoginEmailDomains[0].OAuthClientSecret)).To(Equal("Example.local [REDACTED] [REDACTED]"))
+	})
+
+	It("should ignore services which aren't user-provided or have no domains", func() {
+		os.Setenv("VCAP_SERVICES", `{"p-redis": [{"name": "redis", "label": "p-redis", "credentials": {"domains": [{"domain": "example.local"}]}}],
+			"user-provided": [{"name": "other", "label": "user-provided", "credentials": {"url": "https://other.local"}}]}`)
+
+		_, err := s.ParseConfig([]byte(config))
+		Expect(err).To(MatchError(ContainSubstring("domains[0].session_server_token: must be at least 32 characters")))
+	})
+
+	It("should report unknown keys in the credentials", func() {
+		os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "auth-secrets", "label": "user-provided", "credentials": {"domains": [
+			{"domain": "example.local", "session_server_tokn": "0123456789abcdef0123456789abcdef"}
+		]}}]}`)
+
+		_, err := s.ParseConfig([]byte(config))
+		Expect(err).To(MatchError(ContainSubstring("VCAP_SERVICES: example.local:")))
+		Expect(err).To(MatchError(ContainSubstring("field session_server_tokn not found")))
+	})
+
+	It("should not use VCAP_SERVICES when not running on Cloud Foundry", func() {
+		os.Unsetenv("VCAP_APPLICATION")
+		os.Setenv("VCAP_SERVICES", `{"user-provided": [{"name": "auth-secrets", "label": "user-provided", "credentials": {"domains": [
+			{"domain": "env.local", "enabled": true, "session_server_token": "fedcba9876543210fedcba9876543210"}
+		]}}]}`)
+
+		c, err := s.ParseConfig([]byte("domains:\n  - domain: file.local\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.DomainConfigs).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,323 @@
+package configurator
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minSessionServerTokenLength is the shortest session_server_token accepted, tokens are
+// hashed into AES keys so short ones are easy to guess
+const minSessionServerTokenLength = 32
+
+// providerRequiredFields are the login_email_domains fields each provider needs
+var providerRequiredFields = map[string][]string{
+	"google": {"oauth_client_id", "oauth_client_secret"},
+	"github": {"oauth_client_id", "oauth_client_secret"},
+	"oidc":   {"issuer", "oauth_client_id", "oauth_client_secret"},
+}
+
+var headerNameRegexp = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// Problem is a mistake in a config file, Line is 0 when it isn't known
+type Problem struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d: %s: %s", p.Line, p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Path, p.Message)
+}
+
+// ValidationError lists every problem found in a config
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	var lines []string
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return "invalid config:\n" + strings.Join(lines, "\n")
+}
+
+func validationError(problems []Problem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// ParseConfig parses a YAML config, resolves ${ENV:NAME} and ${FILE:/path} references, merges
+// in any domains from VCAP_SERVICES and strictly validates the result, any unknown keys,
+// unresolved references or invalid settings are returned as a *ValidationError
+func ParseConfig(data []byte) (Config, error) {
+	var (
+		c    Config
+		root yaml.Node
+	)
+
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return c, err
+	}
+
+	var problems []Problem
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil && err != io.EOF {
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return c, err
+		}
+		for _, e := range typeErr.Errors {
+			problems = append(problems, typeErrorProblem(e))
+		}
+	}
+
+	// before interpolating, so resolved secrets don't end up in the problems
+	problems = append(problems, quoteProblems(&root)...)
+
+	changed, refProblems := interpolate(&root, "")
+	problems = append(problems, refProblems...)
+	if changed {
+		// unknown keys and type errors have already been found by the strict decode
+		c = Config{}
+		if err := root.Decode(&c); err != nil {
+			if _, ok := err.(*yaml.TypeError); !ok {
+				return c, err
+			}
+		}
+	}
+
+	if err := c.mergeServices(); err != nil {
+		problems = append(problems, Problem{Path: "VCAP_SERVICES", Message: err.Error()})
+	}
+
+	problems = append(problems, c.problems(&root)...)
+
+	for n := range c.DomainConfigs {
+		c.DomainConfigs[n].compileAccessRules()
+	}
+
+	return c, validationError(problems)
+}
+
+// Validate returns a *ValidationError if the config can't be served
+func (c Config) Validate() error {
+	return validationError(c.problems(nil))
+}
+
+// typeErrorProblem converts a yaml.v3 error, such as "line 3: field x not found in type y"
+func typeErrorProblem(e string) Problem {
+	if strings.HasPrefix(e, "line ") {
+		parts := strings.SplitN(strings.TrimPrefix(e, "line "), ": ", 2)
+		if line, err := strconv.Atoi(parts[0]); err == nil && len(parts) == 2 {
+			return Problem{Line: line, Path: "yaml", Message: parts[1]}
+		}
+	}
+	return Problem{Path: "yaml", Message: e}
+}
+
+// quoteProblems finds plain values ending in a quote, which are usually a missing opening
+// quote, such as `title: Testing"`
+func quoteProblems(node *yaml.Node) []Problem {
+	var problems []Problem
+	if node.Kind == yaml.ScalarNode && node.Style == 0 {
+		v := node.Value
+		if strings.HasSuffix(v, `"`) && !strings.HasPrefix(v, `"`) ||
+			strings.HasSuffix(v, `'`) && !strings.HasPrefix(v, `'`) {
+			problems = append(problems, Problem{Line: node.Line, Path: "yaml", Message: fmt.Sprintf("%s looks like it has an unterminated quote", v)})
+		}
+	}
+	for _, child := range node.Content {
+		problems = append(problems, quoteProblems(child)...)
+	}
+	return problems
+}
+
+// lineOf returns the line of the node at the path of mapping keys and sequence indexes,
+// or of its closest parent if it isn't set
+func lineOf(root *yaml.Node, path ...interface{}) int {
+	if root == nil {
+		return 0
+	}
+
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+
+	line := node.Line
+	for _, step := range path {
+		var next *yaml.Node
+		switch s := step.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for n := 0; n+1 < len(node.Content); n += 2 {
+					if node.Content[n].Value == s {
+						next = node.Content[n+1]
+						break
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && s < len(node.Content) {
+				next = node.Content[s]
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node, line = next, next.Line
+	}
+	return line
+}
+
+func (c Config) problems(root *yaml.Node) []Problem {
+	var problems []Problem
+
+	add := func(message string, path ...interface{}) {
+		var names []string
+		for _, step := range path {
+			switch s := step.(type) {
+			case string:
+				names = append(names, s)
+			case int:
+				names[len(names)-1] += fmt.Sprintf("[%d]", s)
+			}
+		}
+		problems = append(problems, Problem{Line: lineOf(root, path...), Path: strings.Join(names, "."), Message: message})
+	}
+
+	seen := map[string]int{}
+
+	for n, dc := range c.DomainConfigs {
+		// disabled domains aren't served, so they only need to parse
+		if !dc.Enabled {
+			continue
+		}
+
+		if dc.Domain == "" {
+			add("domain is required", "domains", n, "domain")
+		}
+
+		for k, name := range dc.names() {
+			path := []interface{}{"domains", n, "domain"}
+			if k > 0 {
+				path = []interface{}{"domains", n, "aliases", k - 1}
+			}
+			if name == "" {
+				if k > 0 {
+					add("alias can't be empty", path...)
+				}
+				continue
+			}
+
+			if strings.Contains(name, "*") && (!isWildcard(name) || strings.Contains(name[2:], "*") || len(name) == 2) {
+				add(fmt.Sprintf("%s is not a valid wildcard, only the first label can be *, such as *.example.com", name), path...)
+			}
+
+			domain := strings.ToLower(name)
+			if first, dup := seen[domain]; dup {
+				add(fmt.Sprintf("%s is configured more than once, first at domains[%d]", name, first), path...)
+			} else {
+				seen[domain] = n
+			}
+		}
+
+		if len(dc.SessionServerTokens) > 0 {
+			for k, token := range dc.SessionServerTokens {
+				if len(token) < minSessionServerTokenLength {
+					add(fmt.Sprintf("must be at least %d characters", minSessionServerTokenLength), "domains", n, "session_server_tokens", k)
+				}
+			}
+		} else if len(dc.SessionServerToken) < minSessionServerTokenLength {
+			add(fmt.Sprintf("must be at least %d characters", minSessionServerTokenLength), "domains", n, "session_server_token")
+		}
+
+		for k, led := range dc.LoginEmailDomains {
+			if led.Domain == "" {
+				add("domain is required", "domains", n, "login_email_domains", k, "domain")
+			}
+
+			required, known := providerRequiredFields[strings.ToLower(led.Provider)]
+			if !known {
+				add(fmt.Sprintf("'%s' is not a known provider", led.Provider), "domains", n, "login_email_domains", k, "provider")
+				continue
+			}
+
+			values := map[string]string{
+				"oauth_client_id":     led.OAuthClientID,
+				"oauth_client_secret": led.OAuthClientSecret,
+				"issuer":              led.Issuer,
+			}
+			for _, field := range required {
+				if values[field] == "" {
+					add(fmt.Sprintf("%s is required for %s", field, led.Provider), "domains", n, "login_email_domains", k)
+				}
+			}
+
+			// nobody can log in with a GitHub domain which doesn't allow any organisations or teams
+			if strings.ToLower(led.Provider) == "github" && len(led.GitHubOrganisations) == 0 && len(led.GitHubTeams) == 0 {
+				add("github_organisations or github_teams is required for github", "domains", n, "login_email_domains", k)
+			}
+
+			if led.Issuer != "" {
+				if u, err := url.Parse(led.Issuer); err != nil || u.Scheme != "https" || u.Host == "" {
+					add("must be an https URL", "domains", n, "login_email_domains", k, "issuer")
+				}
+			}
+		}
+
+		var names []string
+		for name := range dc.SecurityHeaders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			value := dc.SecurityHeaders[name]
+			if !headerNameRegexp.MatchString(name) {
+				add(fmt.Sprintf("'%s' is not a valid header name", name), "domains", n, "security_headers", name)
+			}
+			if strings.IndexFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+				add("header values can't contain control characters", "domains", n, "security_headers", name)
+			}
+		}
+
+		if dc.Upstream.RewriteURL != "" {
+			if u, err := url.Parse(dc.Upstream.RewriteURL); err != nil || u.Scheme == "" || u.Host == "" {
+				add("must be an absolute URL", "domains", n, "upstream", "rewrite_url")
+			}
+		}
+		if dc.StaticUpstreamURL != "" {
+			if u, err := url.Parse(dc.StaticUpstreamURL); err != nil || u.Scheme == "" || u.Host == "" {
+				add("must be an absolute URL", "domains", n, "upstream_url")
+			}
+		}
+
+		for k, rule := range dc.AccessRules {
+			if rule.Regex == "" {
+				continue
+			}
+			if _, err := regexp.Compile(rule.Regex); err != nil {
+				add(err.Error(), "domains", n, "access_rules", k, "regex")
+			}
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,117 @@
+package configurator_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/configurator"
+)
+
+var _ = Describe("Validate", func() {
+	problems := func(config string) []s.Problem {
+		_, err := s.ParseConfig([]byte(config))
+		Expect(err).To(HaveOccurred())
+
+		verr, ok := err.(*s.ValidationError)
+		Expect(ok).To(BeTrue(), err.Error())
+		return verr.Problems
+	}
+
+	It("should accept the example config", func() {
+		_, err := s.ReadConfigFile("../../test/data/example.yml")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should return syntax errors as they are", func() {
+		_, err := s.ParseConfig([]byte("domains: ["))
+		Expect(err).To(HaveOccurred())
+		_, ok := err.(*s.ValidationError)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should report unknown keys with their line", func() {
+		Expect(problems(`domains:
+  - domain: a.local
+    enabled: true
+    session_server_token: 0123456789abcdef0123456789abcdef
+    sesion_cookie_name: TYPO
+`)).To(ConsistOf(s.Problem{Line: 5, Path: "yaml", Message: "field sesion_cookie_name not found in type configurator.DomainConfig"}))
+	})
+
+	It("should report every problem with an enabled domain", func() {
+		Expect(problems(`domains:
+  - domain: a.local
+    enabled: true
+    session_server_tokens:
+      - 0123456789abcdef0123456789abcdef
+      - short
+    login_email_domains:
+      - domain: a.local
+        provider: google
+        oauth_client_id: abc
+      - domain: b.local
+        provider: oidc
+        issuer: http://b.local
+        oauth_client_id: abc
+        oauth_client_secret: def
+      - provider: unknown
+      - domain: c.local
+        provider: github
+        oauth_client_id: ghi
+        oauth_client_secret: jkl
+    security_headers:
+      "bad header": "value"
+  - domain: A.local
+    enabled: true
+    session_server_token: ""
+    upstream_url: /relative
+    access_rules:
+      - regex: "("
+  - domain: disabled.local
+    session_server_token: short
+`)).To(Equal([]s.Problem{
+			{Line: 6, Path: "domains[0].session_server_tokens[1]", Message: "must be at least 32 characters"},
+			{Line: 8, Path: "domains[0].login_email_domains[0]", Message: "oauth_client_secret is required for google"},
+			{Line: 13, Path: "domains[0].login_email_domains[1].issuer", Message: "must be an https URL"},
+			{Line: 16, Path: "domains[0].login_email_domains[2].domain", Message: "domain is required"},
+			{Line: 16, Path: "domains[0].login_email_domains[2].provider", Message: "'unknown' is not a known provider"},
+			{Line: 17, Path: "domains[0].login_email_domains[3]", Message: "github_organisations or github_teams is required for github"},
+			{Line: 22, Path: "domains[0].security_headers.bad header", Message: "'bad header' is not a valid header name"},
+			{Line: 23, Path: "domains[1].domain", Message: "A.local is configured more than once, first at domains[0]"},
+			{Line: 25, Path: "domains[1].session_server_token", Message: "must be at least 32 characters"},
+			{Line: 26, Path: "domains[1].upstream_url", Message: "must be an absolute URL"},
+			{Line: 28, Path: "domains[1].access_rules[0].regex", Message: "error parsing regexp: missing closing ): `(`"},
+		}))
+	})
+
+	It("should report invalid wildcards and aliases used more than once", func() {
+		Expect(problems(`domains:
+  - domain: "*.apps.local"
+    enabled: true
+    session_server_token: 0123456789abcdef0123456789abcdef
+    aliases:
+      - "a.*.local"
+      - ""
+  - domain: b.local
+    enabled: true
+    session_server_token: 0123456789abcdef0123456789abcdef
+    aliases: ["*.APPS.local"]
+`)).To(Equal([]s.Problem{
+			{Line: 6, Path: "domains[0].aliases[0]", Message: "a.*.local is not a valid wildcard, only the first label can be *, such as *.example.com"},
+			{Line: 7, Path: "domains[0].aliases[1]", Message: "alias can't be empty"},
+			{Line: 11, Path: "domains[1].aliases[0]", Message: "*.APPS.local is configured more than once, first at domains[0]"},
+		}))
+	})
+
+	It("should report values which look like they're missing a quote", func() {
+		Expect(problems(`domains:
+  - domain: a.local
+    auth_pages_title: Testing"
+`)).To(ConsistOf(s.Problem{Line: 3, Path: "yaml", Message: `Testing" looks like it has an unterminated quote`}))
+	})
+
+	It("should format problems with and without lines", func() {
+		Expect(s.Problem{Line: 3, Path: "domains[0].domain", Message: "domain is required"}.String()).To(Equal("line 3: domains[0].domain: domain is required"))
+		Expect(s.Problem{Path: "domains[0].domain", Message: "domain is required"}.String()).To(Equal("domains[0].domain: domain is required"))
+	})
+})
@@ -0,0 +1,157 @@
+package extauthz
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// Server implements Envoy's envoy.service.auth.v3.Authorization gRPC API, making the same
+// decisions as /auth/verify
+type Server struct{}
+
+// NewGRPCServer returns a gRPC server with the Authorization service registered
+func NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	g := grpc.NewServer(opts...)
+	authv3.RegisterAuthorizationServer(g, &Server{})
+	return g
+}
+
+// checkRequest returns the HTTP request being authorised from the check's attributes
+func checkRequest(ctx context.Context, req *authv3.CheckRequest) (*http.Request, bool) {
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+	if attrs == nil || attrs.GetHost() == "" {
+		return nil, false
+	}
+
+	scheme := attrs.GetScheme()
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	u, err := url.Parse(scheme + "://" + attrs.GetHost() + attrs.GetPath())
+	if err != nil || u.Host != attrs.GetHost() {
+		return nil, false
+	}
+
+	request, err := http.NewRequestWithContext(ctx, attrs.GetMethod(), u.String(), nil)
+	if err != nil {
+		return nil, false
+	}
+
+	for k, v := range attrs.GetHeaders() {
+		// pseudo headers, such as :authority, are in the attributes already
+		if !strings.HasPrefix(k, ":") {
+			request.Header.Set(k, v)
+		}
+	}
+	return request, true
+}
+
+// headerOptions converts headers to the options Envoy adds to requests and responses
+func headerOptions(header http.Header) []*corev3.HeaderValueOption {
+	var opts []*corev3.HeaderValueOption
+	for k, vs := range header {
+		for _, v := range vs {
+			opts = append(opts, &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{Key: k, Value: v},
+			})
+		}
+	}
+	return opts
+}
+
+// strippedHeaders returns the client supplied identity and assertion headers, which Envoy
+// should remove
+func strippedHeaders(request *http.Request) []string {
+	stripped := request.Clone(request.Context())
+	i.StripIdentityHeaders(stripped)
+	i.StripAssertionHeaders(stripped)
+
+	var res []string
+	for k := range request.Header {
+		if _, ok := stripped.Header[k]; !ok {
+			res = append(res, strings.ToLower(k))
+		}
+	}
+	return res
+}
+
+func deniedResponse(code codes.Code, response *http.Response) *authv3.CheckResponse {
+	denied := &authv3.DeniedHttpResponse{
+		Status: &typev3.HttpStatus{Code: typev3.StatusCode(response.StatusCode)},
+	}
+
+	header := response.Header.Clone()
+	if response.StatusCode == http.StatusUnauthorized {
+		// send browsers to log in, rather than the 401 page
+		denied.Status.Code = typev3.StatusCode_Found
+		header.Set("Location", header.Get(i.LoginURLHeader))
+	}
+	denied.Headers = headerOptions(header)
+
+	if response.Body != nil {
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		denied.Body = string(body)
+	}
+
+	return &authv3.CheckResponse{
+		Status:       &status.Status{Code: int32(code)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: denied},
+	}
+}
+
+// Check returns OK with the identity headers, or a denied response with a redirect to
+// /auth/login or the forbidden page
+func (s *Server) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	request, ok := checkRequest(ctx, req)
+	if !ok {
+		Debugfln("Check:err: No HTTP request attributes")
+		return &authv3.CheckResponse{
+			Status: &status.Status{Code: int32(codes.InvalidArgument)},
+		}, nil
+	}
+
+	Debugfln("Check:1: %s %s", request.Method, request.URL.String())
+
+	okResponse := &authv3.OkHttpResponse{HeadersToRemove: strippedHeaders(request)}
+
+	// the login pages are served by the route service, which Envoy routes to
+	if i.IsAuthPath(request.URL.EscapedPath()) {
+		Debugfln("Check:2: Auth request")
+		return &authv3.CheckResponse{
+			Status:       &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: okResponse},
+		}, nil
+	}
+
+	response := i.Verify(request)
+	switch response.StatusCode {
+	case http.StatusOK:
+		Debugfln("Check:2: OK")
+		okResponse.Headers = headerOptions(response.Header)
+		return &authv3.CheckResponse{
+			Status:       &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: okResponse},
+		}, nil
+	case http.StatusUnauthorized:
+		Debugfln("Check:2: Unauthenticated")
+		return deniedResponse(codes.Unauthenticated, response), nil
+	}
+
+	Debugfln("Check:2: Denied with %d", response.StatusCode)
+	return deniedResponse(codes.PermissionDenied, response), nil
+}
@@ -0,0 +1,153 @@
+package extauthz_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	s "github.com/OllieJC/authenticating-route-service/internal/extauthz"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+)
+
+var _ = Describe("ExtAuthz", func() {
+	os.Setenv("DOMAIN_CONFIG_FILEPATH", "../../test/data/example.yml")
+	h.TemplatePath = "../../web/template"
+
+	var (
+		server *grpc.Server
+		conn   *grpc.ClientConn
+		client authv3.AuthorizationClient
+	)
+
+	BeforeEach(func() {
+		lis := bufconn.Listen(1024 * 1024)
+		server = s.NewGRPCServer()
+		go server.Serve(lis)
+
+		var err error
+		conn, err = grpc.Dial("bufnet",
+			grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		Expect(err).NotTo(HaveOccurred())
+		client = authv3.NewAuthorizationClient(conn)
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		server.Stop()
+	})
+
+	sessionCookie := func(email string) string {
+		sess := i.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "` + email + `", "organisations": []}`
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+
+		domainRequest := httptest.NewRequest("GET", "https://example.local/", nil)
+		encString, err := i.EncryptSession(string(b), i.GetSessionSvrToken(domainRequest))
+		Expect(err).NotTo(HaveOccurred())
+
+		return (&http.Cookie{Name: i.GetSessionCookieName(domainRequest), Value: encString}).String()
+	}
+
+	check := func(path string, headers map[string]string) *authv3.CheckResponse {
+		res, err := client.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Method:  "GET",
+						Scheme:  "https",
+						Host:    "example.local",
+						Path:    path,
+						Headers: headers,
+					},
+				},
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+
+	headerValue := func(res *authv3.CheckResponse, name string) string {
+		for _, hv := range append(res.GetOkResponse().GetHeaders(), res.GetDeniedResponse().GetHeaders()...) {
+			if http.CanonicalHeaderKey(hv.GetHeader().GetKey()) == http.CanonicalHeaderKey(name) {
+				return hv.GetHeader().GetValue()
+			}
+		}
+		return ""
+	}
+
+	It("should return invalid argument without HTTP attributes", func() {
+		res, err := client.Check(context.Background(), &authv3.CheckRequest{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.InvalidArgument))
+	})
+
+	It("should deny requests without a session with a redirect to log in", func() {
+		res := check("/private?q=1", map[string]string{"x-auth-email": "spoofed@example.local"})
+
+		Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.Unauthenticated))
+		Expect(res.GetDeniedResponse().GetStatus().GetCode()).To(Equal(typev3.StatusCode_Found))
+		Expect(headerValue(res, "Location")).To(Equal("https://example.local/auth/login"))
+		Expect(headerValue(res, "Set-Cookie")).To(HavePrefix("_redirectPath=/private?q=1;"))
+	})
+
+	It("should allow unauthenticated paths and the login pages, removing identity headers", func() {
+		for _, path := range []string{"/test/unauth", "/auth/login"} {
+			res := check(path, map[string]string{"x-auth-email": "spoofed@example.local"})
+
+			Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.OK))
+			Expect(res.GetOkResponse().GetHeadersToRemove()).To(ContainElement("x-auth-email"))
+			Expect(headerValue(res, "X-Auth-Email")).To(BeEmpty())
+		}
+	})
+
+	It("should remove client supplied assertion headers", func() {
+		for path, cookie := range map[string]string{"/test/unauth": "", "/private": sessionCookie("someone@email.example.local")} {
+			res := check(path, map[string]string{"cookie": cookie, "x-auth-assertion": "spoofed", "x-auth-jwt": "spoofed"})
+
+			Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.OK), path)
+			Expect(res.GetOkResponse().GetHeadersToRemove()).To(ContainElement("x-auth-assertion"))
+			Expect(res.GetOkResponse().GetHeadersToRemove()).To(ContainElement("x-auth-jwt"))
+		}
+	})
+
+	It("should not allow upstream paths which only start with /auth", func() {
+		for _, path := range []string{"/authors", "/authorize", "/auth-admin", "/auth%2Flogin"} {
+			res := check(path, nil)
+
+			Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.Unauthenticated), path)
+		}
+	})
+
+	It("should allow sessions with the identity headers", func() {
+		res := check("/private", map[string]string{"cookie": sessionCookie("someone@email.example.local")})
+
+		Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.OK))
+		Expect(headerValue(res, "X-Auth-Email")).To(Equal("someone@email.example.local"))
+		Expect(headerValue(res, "X-Auth-User")).To(Equal("octocat"))
+	})
+
+	It("should deny sessions which the access rules don't allow", func() {
+		res := check("/admin", map[string]string{"cookie": sessionCookie("someone@email.example.local")})
+
+		Expect(res.GetStatus().GetCode()).To(BeEquivalentTo(codes.PermissionDenied))
+		Expect(res.GetDeniedResponse().GetStatus().GetCode()).To(Equal(typev3.StatusCode_Forbidden))
+	})
+})
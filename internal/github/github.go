@@ -0,0 +1,255 @@
+package github
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	a "github.com/OllieJC/authenticating-route-service/internal/audit"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// ProviderString is GitHub
+const ProviderString = "github"
+
+var (
+	// Endpoint is GitHub's OAuth 2.0 endpoint, can be adjusted for testing
+	Endpoint = github.Endpoint
+
+	// APIURL is the base of GitHub's REST API, can be adjusted for testing
+	APIURL = "https://api.github.com"
+
+	errNoVerifiedEmail error = fmt.Errorf("no verified primary email on GitHub account: %w", p.ErrAccountMismatch)
+	errNotMember       error = fmt.Errorf("GitHub account is not a member of an allowed organisation or team: %w", p.ErrAccountMismatch)
+
+	linkNextRegex = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+)
+
+// Scopes: read:org is needed to list private organisation and team memberships.
+var scopes = []string{"read:user", "user:email", "read:org"}
+
+// UserData is the GitHub profile stored in the session
+type UserData struct {
+	Login         string   `json:"login"`
+	Name          string   `json:"name"`
+	Email         string   `json:"email"`
+	Organisations []string `json:"organisations"`
+	Teams         []string `json:"teams"`
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+type githubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+type githubOrg struct {
+	Login string `json:"login"`
+}
+
+type githubTeam struct {
+	Slug         string    `json:"slug"`
+	Organization githubOrg `json:"organization"`
+}
+
+func oauthConfig(dc c.DomainConfig, emailDomain string) *oauth2.Config {
+	return p.OAuthConfig(dc, ProviderString, emailDomain, Endpoint, scopes)
+}
+
+// OAuthGitHubLogin redirects the response to GitHub's authorisation page
+func OAuthGitHubLogin(response *http.Response, dc c.DomainConfig, emailDomain string) {
+	Debugfln("OAuthGitHubLogin:1: Start...")
+
+	oauthState := h.GenerateStateOauthCookie(response)
+	oAuthUrl := oauthConfig(dc, emailDomain).AuthCodeURL(oauthState)
+
+	h.RedirectResponse(response, http.StatusSeeOther, oAuthUrl)
+}
+
+// OauthGitHubCallback exchanges the code for a token and returns the user data if the user is allowed
+func OauthGitHubCallback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	Debugfln("OauthGitHubCallback:1: Start...")
+
+	if !h.ValidStateOauthCookie(request) {
+		Debugfln("OauthGitHubCallback:err: state bad")
+		return "", fmt.Errorf("ERROR: OauthGitHubCallback: state bad")
+	}
+
+	escPath := request.URL.EscapedPath()
+	sep := strings.Split(escPath, "/")
+	domain := strings.ToLower(sep[len(sep)-1])
+
+	data, err := getUserDataFromGitHub(request.FormValue("code"), dc, domain)
+	if err == nil && !isMember(data, dc.GetLoginEmailDomain(domain, ProviderString)) {
+		err = errNotMember
+	}
+	if errors.Is(err, p.ErrAccountMismatch) {
+		Debugfln("OauthGitHubCallback:err: %s", err.Error())
+
+		a.Event("github_account_mismatch", request, map[string]string{
+			"provider":     ProviderString,
+			"email_domain": domain,
+			"login":        data.Login,
+			"email":        data.Email,
+			"reason":       err.Error(),
+		})
+
+		return "", err
+	} else if err != nil {
+		Debugfln("OauthGitHubCallback:err: %#v", err)
+		return "", fmt.Errorf("ERROR: OauthGitHubCallback: %s", err.Error())
+	}
+
+	Debugfln("OauthGitHubCallback:2: No error...")
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// isMember returns true if the user is in one of the allowed organisations or teams
+func isMember(data UserData, led c.LoginEmailDomain) bool {
+	for _, allowed := range led.GitHubOrganisations {
+		for _, org := range data.Organisations {
+			if strings.ToLower(allowed) == strings.ToLower(org) {
+				return true
+			}
+		}
+	}
+	for _, allowed := range led.GitHubTeams {
+		for _, team := range data.Teams {
+			if strings.ToLower(allowed) == strings.ToLower(team) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getUserDataFromGitHub(code string, dc c.DomainConfig, emailDomain string) (UserData, error) {
+	var data UserData
+
+	Debugfln("getUserDataFromGitHub:1: Starting...")
+
+	conf := oauthConfig(dc, emailDomain)
+
+	token, err := conf.Exchange(oauth2.NoContext, code)
+	if err != nil {
+		Debugfln("getUserDataFromGitHub:1:err: %#v", err)
+		return data, fmt.Errorf("code exchange wrong: %s", err.Error())
+	}
+
+	client := conf.Client(oauth2.NoContext, token)
+
+	var user githubUser
+	if err = getJSON(client, APIURL+"/user", &user); err != nil {
+		return data, err
+	}
+	data.Login = user.Login
+	data.Name = user.Name
+
+	Debugfln("getUserDataFromGitHub:2: Getting emails for %s", data.Login)
+
+	var emails []githubEmail
+	if err = getJSON(client, APIURL+"/user/emails?per_page=100", &emails); err != nil {
+		return data, err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			data.Email = e.Email
+			break
+		}
+	}
+	if data.Email == "" {
+		return data, errNoVerifiedEmail
+	}
+
+	Debugfln("getUserDataFromGitHub:3: Getting memberships for %s", data.Login)
+
+	var orgs []githubOrg
+	if err = getJSON(client, APIURL+"/user/orgs?per_page=100", &orgs); err != nil {
+		return data, err
+	}
+	for _, o := range orgs {
+		data.Organisations = append(data.Organisations, o.Login)
+	}
+
+	var teams []githubTeam
+	if err = getJSON(client, APIURL+"/user/teams?per_page=100", &teams); err != nil {
+		return data, err
+	}
+	for _, t := range teams {
+		data.Teams = append(data.Teams, fmt.Sprintf("%s/%s", t.Organization.Login, t.Slug))
+	}
+
+	Debugfln("getUserDataFromGitHub:4: Returning GitHub profile")
+
+	return data, nil
+}
+
+// getJSON decodes a GitHub API response into v, following "next" links for lists
+func getJSON(client *http.Client, url string, v interface{}) error {
+	var items []json.RawMessage
+
+	for url != "" {
+		request, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Accept", "application/vnd.github.v3+json")
+
+		response, err := client.Do(request)
+		if err != nil {
+			return fmt.Errorf("failed getting %s: %s", url, err.Error())
+		}
+
+		contents, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed read response: %s", err.Error())
+		}
+
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed getting %s: status %d", url, response.StatusCode)
+		}
+
+		if !strings.HasPrefix(strings.TrimSpace(string(contents)), "[") {
+			return json.Unmarshal(contents, v)
+		}
+
+		var page []json.RawMessage
+		if err = json.Unmarshal(contents, &page); err != nil {
+			return err
+		}
+		items = append(items, page...)
+
+		url = ""
+		if m := linkNextRegex.FindStringSubmatch(response.Header.Get("Link")); len(m) == 2 {
+			url = m[1]
+		}
+	}
+
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
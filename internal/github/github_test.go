@@ -0,0 +1,248 @@
+package github_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	gh "github.com/OllieJC/authenticating-route-service/internal/github"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+const testToken = "gho_test"
+
+type fakeGitHub struct {
+	server *httptest.Server
+	emails []map[string]interface{}
+	orgs   [][]map[string]interface{}
+	teams  []map[string]interface{}
+}
+
+func newFakeGitHub() *fakeGitHub {
+	f := &fakeGitHub{
+		emails: []map[string]interface{}{
+			{"email": "other@example.com", "primary": false, "verified": true},
+			{"email": "octocat@third.example.local", "primary": true, "verified": true},
+		},
+		orgs: [][]map[string]interface{}{
+			{{"login": "some-org"}},
+			{{"login": "example-org"}},
+		},
+		teams: []map[string]interface{}{
+			{"slug": "devs", "organization": map[string]interface{}{"login": "other-org"}},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+		}
+		if r.FormValue("code") != "good" || clientID != "ghi" || clientSecret != "456" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "%s", "token_type": "bearer"}`, testToken)
+	})
+
+	api := func(fn func(w http.ResponseWriter, r *http.Request) interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+testToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(fn(w, r))
+		}
+	}
+	mux.HandleFunc("/user", api(func(w http.ResponseWriter, r *http.Request) interface{} {
+		return map[string]interface{}{"login": "octocat", "name": "Mona"}
+	}))
+	mux.HandleFunc("/user/emails", api(func(w http.ResponseWriter, r *http.Request) interface{} {
+		return f.emails
+	}))
+	mux.HandleFunc("/user/orgs", api(func(w http.ResponseWriter, r *http.Request) interface{} {
+		page := 0
+		fmt.Sscanf(r.URL.Query().Get("page"), "%d", &page)
+		if page < len(f.orgs)-1 {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/user/orgs?per_page=100&page=%d>; rel="next"`, f.server.URL, page+1))
+		}
+		if page >= len(f.orgs) {
+			return []interface{}{}
+		}
+		return f.orgs[page]
+	}))
+	mux.HandleFunc("/user/teams", api(func(w http.ResponseWriter, r *http.Request) interface{} {
+		return f.teams
+	}))
+
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+func callbackRequest(code string) (*http.Request, *http.Response) {
+	response := h.EmptyHTTPResponse(nil)
+	state := h.GenerateStateOauthCookie(response)
+
+	path := "/auth/callback/github/third.example.local"
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.local%s", path), nil)
+	request.Header = http.Header{"Cookie": []string{response.Header.Get("Set-Cookie")}}
+	request.Form = url.Values{}
+	request.Form.Add("state", state)
+	request.Form.Add("code", code)
+
+	return request, h.EmptyHTTPResponse(request)
+}
+
+var _ = Describe("GitHub", func() {
+	var (
+		fake             *fakeGitHub
+		originalEndpoint = gh.Endpoint
+		originalAPIURL   = gh.APIURL
+		dc               c.DomainConfig
+	)
+
+	BeforeEach(func() {
+		fake = newFakeGitHub()
+		gh.Endpoint.AuthURL = fake.server.URL + "/login/oauth/authorize"
+		gh.Endpoint.TokenURL = fake.server.URL + "/login/oauth/access_token"
+		gh.APIURL = fake.server.URL
+		p.ResetOAuthConfigCaches()
+
+		dc = c.DomainConfig{
+			Domain: "example.local",
+			LoginEmailDomains: []c.LoginEmailDomain{
+				{
+					Domain:              "third.example.local",
+					Provider:            "github",
+					OAuthClientID:       "ghi",
+					OAuthClientSecret:   "456",
+					GitHubOrganisations: []string{"Example-Org"},
+					GitHubTeams:         []string{"other-org/admins"},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		fake.server.Close()
+		gh.Endpoint = originalEndpoint
+		gh.APIURL = originalAPIURL
+	})
+
+	It("should set an oauthstate cookie, location header and redirect with OAuthGitHubLogin", func() {
+		r := h.EmptyHTTPResponse(nil)
+		gh.OAuthGitHubLogin(r, dc, "third.example.local")
+
+		Expect(r.StatusCode).To(Equal(http.StatusSeeOther))
+		Expect(r.Header.Get("Set-Cookie")).To(ContainSubstring("oauthstate="))
+
+		loc, err := r.Location()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loc.Path).To(Equal("/login/oauth/authorize"))
+		Expect(loc.Query().Get("client_id")).To(Equal("ghi"))
+		Expect(loc.Query().Get("scope")).To(ContainSubstring("read:org"))
+		Expect(loc.Query().Get("redirect_uri")).To(Equal("https://example.local/auth/callback/github/third.example.local"))
+	})
+
+	It("should return the profile of a member of an allowed organisation", func() {
+		request, response := callbackRequest("good")
+
+		cbResp, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).NotTo(HaveOccurred())
+
+		var data gh.UserData
+		Expect(json.Unmarshal([]byte(cbResp), &data)).To(Succeed())
+		Expect(data.Login).To(Equal("octocat"))
+		Expect(data.Email).To(Equal("octocat@third.example.local"))
+		Expect(data.Organisations).To(ConsistOf("some-org", "example-org"))
+		Expect(data.Teams).To(ConsistOf("other-org/devs"))
+	})
+
+	It("should admit a member of an allowed team", func() {
+		fake.orgs = nil
+		fake.teams = []map[string]interface{}{
+			{"slug": "admins", "organization": map[string]interface{}{"login": "other-org"}},
+		}
+		request, response := callbackRequest("good")
+
+		cbResp, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cbResp).To(ContainSubstring("other-org/admins"))
+	})
+
+	It("should reject a user who is not in an allowed organisation or team", func() {
+		fake.orgs = [][]map[string]interface{}{{{"login": "some-org"}}}
+		request, response := callbackRequest("good")
+
+		cbResp, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("not a member"))
+		Expect(errors.Is(err, p.ErrAccountMismatch)).To(BeTrue())
+		Expect(cbResp).To(Equal(""))
+	})
+
+	It("should reject everyone when no organisations or teams are listed", func() {
+		dc.LoginEmailDomains[0].GitHubOrganisations = nil
+		dc.LoginEmailDomains[0].GitHubTeams = nil
+		request, response := callbackRequest("good")
+
+		_, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject a user without a verified primary email", func() {
+		fake.emails = []map[string]interface{}{
+			{"email": "octocat@third.example.local", "primary": true, "verified": false},
+		}
+		request, response := callbackRequest("good")
+
+		_, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("verified primary email"))
+		Expect(errors.Is(err, p.ErrAccountMismatch)).To(BeTrue())
+	})
+
+	It("should return an error when the code exchange fails", func() {
+		request, response := callbackRequest("bad")
+
+		_, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("code exchange wrong"))
+	})
+
+	It("should return an error when the state does not match", func() {
+		request, response := callbackRequest("good")
+		request.Form.Set("state", "nope")
+
+		_, err := gh.OauthGitHubCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("state bad"))
+	})
+
+	It("should register as a provider and use organisations and teams as groups", func() {
+		idp, ok := p.Get(gh.ProviderString)
+		Expect(ok).To(BeTrue())
+
+		request, response := callbackRequest("good")
+		cbResp, err := idp.Callback(request, response, dc)
+		Expect(err).NotTo(HaveOccurred())
+
+		ident, err := idp.Identity(cbResp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ident.User).To(Equal("octocat"))
+		Expect(ident.Email).To(Equal("octocat@third.example.local"))
+		Expect(ident.Groups).To(ConsistOf("some-org", "example-org", "other-org/devs"))
+	})
+})
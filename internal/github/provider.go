@@ -0,0 +1,52 @@
+package github
+
+import (
+	"encoding/json"
+	"net/http"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+type githubProvider struct{}
+
+func init() {
+	p.Register(githubProvider{})
+}
+
+func (githubProvider) Name() string {
+	return ProviderString
+}
+
+func (githubProvider) Login(request *http.Request, response *http.Response, dc c.DomainConfig, emailDomain string) error {
+	OAuthGitHubLogin(response, dc, emailDomain)
+	return nil
+}
+
+func (githubProvider) Callback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	return OauthGitHubCallback(request, response, dc)
+}
+
+// Identity uses organisations and "org/team" slugs as groups
+func (githubProvider) Identity(userData string) (p.Identity, error) {
+	var data UserData
+	if err := json.Unmarshal([]byte(userData), &data); err != nil {
+		return p.Identity{}, err
+	}
+
+	var groups []string
+	groups = append(groups, data.Organisations...)
+	groups = append(groups, data.Teams...)
+
+	return p.Identity{
+		Provider: ProviderString,
+		Email:    data.Email,
+		User:     data.Login,
+		Name:     data.Name,
+		Groups:   groups,
+	}, nil
+}
+
+func (githubProvider) LogoutURL(dc c.DomainConfig, userData string) string {
+	return ""
+}
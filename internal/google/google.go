@@ -1,17 +1,18 @@
 package google
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"time"
 
-	c "authenticating-route-service/internal/configurator"
-	h "authenticating-route-service/internal/httphelper"
-	u "authenticating-route-service/internal/utils"
-	. "authenticating-route-service/pkg/debugprint"
+	a "github.com/OllieJC/authenticating-route-service/internal/audit"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -19,32 +20,22 @@ import (
 
 // ProviderString is Google
 const ProviderString = "google"
-const redirectFormatString = "%s://%s/auth/callback/google/%s"
+
+var (
+	// Endpoint is Google's OAuth 2.0 endpoint, can be adjusted for testing
+	Endpoint = google.Endpoint
+
+	// UserInfoURL is where the Google profile is read from, can be adjusted for testing
+	UserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+)
 
 // Scopes: OAuth 2.0 scopes provide a way to limit the amount of access that is granted to an access token.
-var googleOauthConfig = &oauth2.Config{
-	Scopes:   []string{"profile", "email", "https://www.googleapis.com/auth/userinfo.email"},
-	Endpoint: google.Endpoint,
-}
+var scopes = []string{"profile", "email", "https://www.googleapis.com/auth/userinfo.email"}
 
-func setOauthConfig(dc c.DomainConfig, emailDomain string) {
-	setVal := ""
-	if emailDomain != "" {
-		if dc.Domain != "" {
-			setVal = fmt.Sprintf(redirectFormatString, "https", dc.Domain, emailDomain)
-			googleOauthConfig.RedirectURL = setVal
-			Debugfln("setOauthConfig: Setting RedirectURL to: %s", setVal)
-		}
-		gled := dc.GetLoginEmailDomain(emailDomain, ProviderString)
-		if gled.Provider == "google" {
-			googleOauthConfig.ClientID = gled.OAuthClientID
-			googleOauthConfig.ClientSecret = gled.OAuthClientSecret
-		}
-	}
+func oauthConfig(dc c.DomainConfig, emailDomain string) *oauth2.Config {
+	return p.OAuthConfig(dc, ProviderString, emailDomain, Endpoint, scopes)
 }
 
-const oauthGoogleUrlAPI = "https://www.googleapis.com/oauth2/v2/userinfo?access_token="
-
 func OAuthGoogleLogin(response *http.Response, dc c.DomainConfig, emailDomain string) {
 	Debugfln("OAuthGoogleLogin:1: Start...")
 
@@ -55,8 +46,7 @@ func OAuthGoogleLogin(response *http.Response, dc c.DomainConfig, emailDomain st
 	   AuthCodeURL receive state that is a token to protect the user from CSRF attacks. You must always provide a non-empty string and
 	   validate that it matches the the state query parameter on your redirect callback.
 	*/
-	setOauthConfig(dc, emailDomain)
-	oAuthUrl := googleOauthConfig.AuthCodeURL(oauthState)
+	oAuthUrl := oauthConfig(dc, emailDomain).AuthCodeURL(oauthState, oauth2.SetAuthURLParam("hd", emailDomain))
 
 	h.RedirectResponse(response, http.StatusSeeOther, oAuthUrl)
 }
@@ -64,12 +54,7 @@ func OAuthGoogleLogin(response *http.Response, dc c.DomainConfig, emailDomain st
 func OauthGoogleCallback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
 	Debugfln("OauthGoogleCallback:1: Start...")
 
-	oauthState, err := request.Cookie("oauthstate")
-
-	if err != nil {
-		Debugfln("OauthGoogleCallback:err: %#v", err)
-		return "", fmt.Errorf("ERROR: OauthGoogleCallback: state bad")
-	} else if request.FormValue("state") != oauthState.Value {
+	if !h.ValidStateOauthCookie(request) {
 		Debugfln("OauthGoogleCallback:err: state bad")
 		return "", fmt.Errorf("ERROR: OauthGoogleCallback: state bad")
 	}
@@ -87,50 +72,68 @@ func OauthGoogleCallback(request *http.Request, response *http.Response, dc c.Do
 
 	Debugfln("OauthGoogleCallback:2: No error...")
 
-	if len(data) > 0 {
-
-		return string(data), nil
-
-	} else {
-
+	if len(data) == 0 {
 		err = errors.New("unable to get Google profile")
 		Debugfln("OauthGoogleCallback:err: %#v", err)
 		return "", err
+	}
 
+	var ui userInfo
+	if err = json.Unmarshal(data, &ui); err != nil {
+		Debugfln("OauthGoogleCallback:err: %#v", err)
+		return "", fmt.Errorf("ERROR: OauthGoogleCallback: bad Google profile - %s", err.Error())
 	}
-}
 
-func GenerateStateOauthCookie(resp *http.Response) string {
-	var expiration = time.Now().Add(365 * 24 * time.Hour)
+	if err = checkAccount(ui, domain); err != nil {
+		Debugfln("OauthGoogleCallback:err: %s", err.Error())
 
-	Debugfln("GenerateStateOauthCookie:1: Adding cookie with time until: %s", expiration.String())
+		a.Event("google_account_mismatch", request, map[string]string{
+			"provider":       ProviderString,
+			"email_domain":   domain,
+			"email":          ui.Email,
+			"hd":             ui.HostedDomain,
+			"verified_email": fmt.Sprintf("%t", ui.VerifiedEmail),
+		})
 
-	b, err := u.GenerateRandomBytes(16, true)
-	if err != nil {
-		panic(fmt.Sprintf("generateRandomBytes is unavailable: failed with %#v", err))
+		return "", err
 	}
 
-	state := string(b)
-	cookie := http.Cookie{
-		Name:     "oauthstate",
-		Value:    state,
-		Expires:  expiration,
-		HttpOnly: true,
-		Secure:   true,
+	return string(data), nil
+}
+
+// checkAccount returns an error wrapping p.ErrAccountMismatch unless the profile has a verified
+// email address, and both the email and hosted domain ("hd") match the requested email domain
+func checkAccount(ui userInfo, emailDomain string) error {
+	if !ui.VerifiedEmail {
+		return fmt.Errorf("email address is not verified: %w", p.ErrAccountMismatch)
 	}
 
-	resp.Header.Add("Set-Cookie", cookie.String())
+	se := strings.Split(ui.Email, "@")
+	if len(se) < 2 || strings.ToLower(se[len(se)-1]) != emailDomain {
+		return fmt.Errorf("%s is not a %s email address: %w", ui.Email, emailDomain, p.ErrAccountMismatch)
+	}
+
+	if strings.ToLower(ui.HostedDomain) != emailDomain {
+		return fmt.Errorf("%s is not a %s Google account: %w", ui.Email, emailDomain, p.ErrAccountMismatch)
+	}
 
-	return state
+	return nil
+}
+
+// GenerateStateOauthCookie sets the oauthstate cookie and returns the state
+func GenerateStateOauthCookie(resp *http.Response) string {
+	Debugfln("GenerateStateOauthCookie:1: Adding cookie")
+
+	return h.GenerateStateOauthCookie(resp)
 }
 
 func getUserDataFromGoogle(code string, dc c.DomainConfig, emailDomain string) ([]byte, error) {
 	// Use code to get token and get user info from Google.
 	Debugfln("getUserDataFromGoogle:1: Starting...")
 
-	setOauthConfig(dc, emailDomain)
+	conf := oauthConfig(dc, emailDomain)
 
-	token, err := googleOauthConfig.Exchange(oauth2.NoContext, code)
+	token, err := conf.Exchange(oauth2.NoContext, code)
 	if err != nil {
 		Debugfln("getUserDataFromGoogle:1:err: %#v", err)
 		return nil, fmt.Errorf("code exchange wrong: %s", err.Error())
@@ -138,16 +141,15 @@ func getUserDataFromGoogle(code string, dc c.DomainConfig, emailDomain string) (
 
 	Debugfln("getUserDataFromGoogle:2: Trying get google profile...")
 
-	client := googleOauthConfig.Client(oauth2.NoContext, token)
-	response, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
-
-	Debugfln("getUserDataFromGoogle:2: Userinfo status code: %d", response.StatusCode)
-
+	client := conf.Client(oauth2.NoContext, token)
+	response, err := client.Get(UserInfoURL)
 	if err != nil {
 		Debugfln("getUserDataFromGoogle:2:err: %#v", err)
 		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
 	}
 
+	Debugfln("getUserDataFromGoogle:2: Userinfo status code: %d", response.StatusCode)
+
 	Debugfln("getUserDataFromGoogle:3: Trying to return google profile...")
 
 	contents, err := ioutil.ReadAll(response.Body)
@@ -2,17 +2,25 @@ package google_test
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	c "authenticating-route-service/internal/configurator"
-	g "authenticating-route-service/internal/google"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	g "github.com/OllieJC/authenticating-route-service/internal/google"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
 )
 
 var _ = Describe("Google", func() {
@@ -87,4 +95,302 @@ var _ = Describe("Google", func() {
 		Expect(string(bodyBytes)).Should(ContainSubstring(`http-equiv="refresh"`))
 		Expect(string(bodyBytes)).Should(ContainSubstring(expectedHostnameInRedirect))
 	})
+
+	It("should register as a provider and normalise the Google profile", func() {
+		idp, ok := p.Get(g.ProviderString)
+		Expect(ok).To(BeTrue())
+
+		ident, err := idp.Identity(`{"id": "123", "email": "test@email.example.local", "name": "Test User"}`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ident.Provider).To(Equal("google"))
+		Expect(ident.Email).To(Equal("test@email.example.local"))
+		Expect(ident.Name).To(Equal("Test User"))
+
+		_, err = idp.Identity("not json")
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("with concurrent logins across tenants", func() {
+		var (
+			fakeGoogle          *httptest.Server
+			originalEndpoint    = g.Endpoint
+			originalUserInfoURL = g.UserInfoURL
+		)
+
+		tenant := func(name string) c.DomainConfig {
+			return c.DomainConfig{
+				Domain: fmt.Sprintf("%s.example.local", name),
+				LoginEmailDomains: []c.LoginEmailDomain{
+					{
+						Domain:            fmt.Sprintf("%s.email.local", name),
+						Provider:          "google",
+						OAuthClientID:     fmt.Sprintf("client-%s", name),
+						OAuthClientSecret: fmt.Sprintf("secret-%s", name),
+					},
+				},
+			}
+		}
+		tenants := []c.DomainConfig{tenant("a"), tenant("b"), tenant("c")}
+
+		BeforeEach(func() {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				clientID, clientSecret, ok := r.BasicAuth()
+				if !ok {
+					clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+				}
+				name := strings.TrimPrefix(clientID, "client-")
+				if r.FormValue("code") != "code-"+name || clientSecret != "secret-"+name {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprintf(w, `{"access_token": "token-%s", "token_type": "Bearer"}`, name)
+			})
+			mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+				name := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer token-")
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"email":          fmt.Sprintf("user@%s.email.local", name),
+					"verified_email": true,
+					"hd":             fmt.Sprintf("%s.email.local", name),
+				})
+			})
+			fakeGoogle = httptest.NewServer(mux)
+
+			g.Endpoint.AuthURL = fakeGoogle.URL + "/auth"
+			g.Endpoint.TokenURL = fakeGoogle.URL + "/token"
+			g.UserInfoURL = fakeGoogle.URL + "/userinfo"
+			p.ResetOAuthConfigCaches()
+		})
+
+		AfterEach(func() {
+			fakeGoogle.Close()
+			g.Endpoint = originalEndpoint
+			g.UserInfoURL = originalUserInfoURL
+			p.ResetOAuthConfigCaches()
+		})
+
+		It("should use rotated client credentials after the config is reloaded", func() {
+			tempDir, err := ioutil.TempDir("", "google")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.RemoveAll(tempDir)
+
+			configPath := filepath.Join(tempDir, "config.yml")
+			writeConfig := func(secret string, modTime time.Time) {
+				Expect(ioutil.WriteFile(configPath, []byte(`domains:
+  - domain: reload.example.local
+    enabled: true
+    session_server_token: 0123456789abcdef0123456789abcdef
+    login_email_domains:
+      - domain: r.email.local
+        provider: google
+        oauth_client_id: client-r
+        oauth_client_secret: `+secret+`
+`), 0600)).To(Succeed())
+				Expect(os.Chtimes(configPath, modTime, modTime)).To(Succeed())
+			}
+
+			callback := func() error {
+				dc, err := c.GetDomainConfig("reload.example.local", configPath)
+				Expect(err).NotTo(HaveOccurred())
+
+				loginResponse := &http.Response{Header: http.Header{}}
+				g.OAuthGoogleLogin(loginResponse, dc, "r.email.local")
+				loc, err := loginResponse.Location()
+				Expect(err).NotTo(HaveOccurred())
+
+				request, _ := http.NewRequest("GET", "http://reload.example.local/auth/callback/google/r.email.local", nil)
+				request.Header = http.Header{"Cookie": []string{loginResponse.Header.Get("Set-Cookie")}}
+				request.Form = url.Values{"state": {loc.Query().Get("state")}, "code": {"code-r"}}
+
+				_, err = g.OauthGoogleCallback(request, &http.Response{Header: http.Header{}}, dc)
+				return err
+			}
+
+			writeConfig("revoked-secret", time.Now().Add(-time.Hour))
+			Expect(callback()).To(HaveOccurred())
+
+			writeConfig("secret-r", time.Now())
+			Expect(c.Reload(true)).To(Succeed())
+			Expect(callback()).To(Succeed())
+		})
+
+		It("should only use each tenant's own client credentials", func() {
+			var wg sync.WaitGroup
+			errs := make(chan error, 50*len(tenants))
+
+			for n := 0; n < 50; n++ {
+				for _, dc := range tenants {
+					wg.Add(1)
+					go func(dc c.DomainConfig) {
+						defer wg.Done()
+						led := dc.LoginEmailDomains[0]
+
+						loginResponse := &http.Response{Header: http.Header{}}
+						g.OAuthGoogleLogin(loginResponse, dc, led.Domain)
+
+						loc, err := loginResponse.Location()
+						if err != nil {
+							errs <- err
+							return
+						}
+						if loc.Query().Get("client_id") != led.OAuthClientID {
+							errs <- fmt.Errorf("%s got client_id %s", dc.Domain, loc.Query().Get("client_id"))
+							return
+						}
+						expectedRedirect := fmt.Sprintf("https://%s/auth/callback/google/%s", dc.Domain, led.Domain)
+						if loc.Query().Get("redirect_uri") != expectedRedirect {
+							errs <- fmt.Errorf("%s got redirect_uri %s", dc.Domain, loc.Query().Get("redirect_uri"))
+							return
+						}
+
+						path := fmt.Sprintf("http://%s/auth/callback/google/%s", dc.Domain, led.Domain)
+						request, _ := http.NewRequest("GET", path, nil)
+						request.Header = http.Header{"Cookie": []string{loginResponse.Header.Get("Set-Cookie")}}
+						request.Form = url.Values{
+							"state": {loc.Query().Get("state")},
+							"code":  {"code-" + strings.TrimPrefix(led.OAuthClientID, "client-")},
+						}
+
+						cbResp, err := g.OauthGoogleCallback(request, &http.Response{Header: http.Header{}}, dc)
+						if err != nil {
+							errs <- fmt.Errorf("%s: %s", dc.Domain, err.Error())
+							return
+						}
+						if !strings.Contains(cbResp, "@"+led.Domain) {
+							errs <- fmt.Errorf("%s got profile %s", dc.Domain, cbResp)
+						}
+					}(dc)
+				}
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should share one config between the hosts of a wildcard domain", func() {
+			login := func(dc c.DomainConfig) url.Values {
+				loginResponse := &http.Response{Header: http.Header{}}
+				g.OAuthGoogleLogin(loginResponse, dc, "w.email.local")
+				loc, err := loginResponse.Location()
+				Expect(err).NotTo(HaveOccurred())
+				return loc.Query()
+			}
+			wildcard := func(host, clientID string) c.DomainConfig {
+				return c.DomainConfig{
+					Domain:        host,
+					MatchedDomain: "*.preview.example.local",
+					LoginEmailDomains: []c.LoginEmailDomain{
+						{Domain: "w.email.local", Provider: "google", OAuthClientID: clientID, OAuthClientSecret: "secret-w"},
+					},
+				}
+			}
+
+			first := login(wildcard("pr-1.preview.example.local", "client-w"))
+			Expect(first.Get("client_id")).To(Equal("client-w"))
+			Expect(first.Get("redirect_uri")).To(Equal("https://pr-1.preview.example.local/auth/callback/google/w.email.local"))
+
+			second := login(wildcard("pr-2.preview.example.local", "client-unused"))
+			Expect(second.Get("client_id")).To(Equal("client-w"))
+			Expect(second.Get("redirect_uri")).To(Equal("https://pr-2.preview.example.local/auth/callback/google/w.email.local"))
+		})
+	})
+
+	Context("when checking the returned account", func() {
+		var (
+			fakeGoogle          *httptest.Server
+			profile             map[string]interface{}
+			originalEndpoint    = g.Endpoint
+			originalUserInfoURL = g.UserInfoURL
+			dc                  = c.DomainConfig{
+				Domain: "example.local",
+				LoginEmailDomains: []c.LoginEmailDomain{
+					{Domain: "email.example.local", Provider: "google", OAuthClientID: "abc", OAuthClientSecret: "123"},
+				},
+			}
+		)
+
+		BeforeEach(func() {
+			profile = map[string]interface{}{
+				"email":          "test@email.example.local",
+				"verified_email": true,
+				"hd":             "email.example.local",
+			}
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer"}`)
+			})
+			mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(profile)
+			})
+			fakeGoogle = httptest.NewServer(mux)
+
+			g.Endpoint.TokenURL = fakeGoogle.URL + "/token"
+			g.UserInfoURL = fakeGoogle.URL + "/userinfo"
+			p.ResetOAuthConfigCaches()
+		})
+
+		AfterEach(func() {
+			fakeGoogle.Close()
+			g.Endpoint = originalEndpoint
+			g.UserInfoURL = originalUserInfoURL
+			p.ResetOAuthConfigCaches()
+		})
+
+		callback := func() (string, error) {
+			response := &http.Response{Header: http.Header{}}
+			state := g.GenerateStateOauthCookie(response)
+
+			request, _ := http.NewRequest("GET", "http://example.local/auth/callback/google/email.example.local", nil)
+			request.Header = http.Header{"Cookie": []string{response.Header.Get("Set-Cookie")}}
+			request.Form = url.Values{"state": {state}, "code": {"xxx"}}
+
+			return g.OauthGoogleCallback(request, response, dc)
+		}
+
+		It("should accept a verified account in the requested domain", func() {
+			cbResp, err := callback()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cbResp).To(ContainSubstring("test@email.example.local"))
+		})
+
+		It("should reject an unverified email address", func() {
+			profile["verified_email"] = false
+
+			_, err := callback()
+			Expect(errors.Is(err, p.ErrAccountMismatch)).To(BeTrue())
+		})
+
+		It("should reject a personal account", func() {
+			profile["email"] = "someone@gmail.com"
+			delete(profile, "hd")
+
+			_, err := callback()
+			Expect(errors.Is(err, p.ErrAccountMismatch)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("someone@gmail.com"))
+		})
+
+		It("should reject an account from another hosted domain", func() {
+			profile["hd"] = "other.example.local"
+
+			_, err := callback()
+			Expect(errors.Is(err, p.ErrAccountMismatch)).To(BeTrue())
+		})
+
+		It("should ask Google for an account in the email domain", func() {
+			r := &http.Response{Header: http.Header{}}
+			g.OAuthGoogleLogin(r, dc, "email.example.local")
+
+			loc, err := r.Location()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(loc.Query().Get("hd")).To(Equal("email.example.local"))
+		})
+	})
 })
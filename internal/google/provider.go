@@ -0,0 +1,53 @@
+package google
+
+import (
+	"encoding/json"
+	"net/http"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+type googleProvider struct{}
+
+func init() {
+	p.Register(googleProvider{})
+}
+
+type userInfo struct {
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	VerifiedEmail bool   `json:"verified_email"`
+	HostedDomain  string `json:"hd"`
+	Name          string `json:"name"`
+}
+
+func (googleProvider) Name() string {
+	return ProviderString
+}
+
+func (googleProvider) Login(request *http.Request, response *http.Response, dc c.DomainConfig, emailDomain string) error {
+	OAuthGoogleLogin(response, dc, emailDomain)
+	return nil
+}
+
+func (googleProvider) Callback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	return OauthGoogleCallback(request, response, dc)
+}
+
+func (googleProvider) Identity(userData string) (p.Identity, error) {
+	var ui userInfo
+	if err := json.Unmarshal([]byte(userData), &ui); err != nil {
+		return p.Identity{}, err
+	}
+	return p.Identity{
+		Provider: ProviderString,
+		Email:    ui.Email,
+		User:     ui.Email,
+		Name:     ui.Name,
+	}, nil
+}
+
+func (googleProvider) LogoutURL(dc c.DomainConfig, userData string) string {
+	return ""
+}
@@ -1,10 +1,10 @@
 package httphelper
 
 import (
-	c "authenticating-route-service/internal/configurator"
 	"bytes"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -12,10 +12,16 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	u "github.com/OllieJC/authenticating-route-service/internal/utils"
 )
 
 var TemplatePath = "web/template"
 
+// StateCookieName is the cookie used to protect OAuth flows from CSRF attacks
+const StateCookieName = "oauthstate"
+
 type templatePageData struct {
 	Title      string
 	ErrorText  string
@@ -49,7 +55,7 @@ func TemplateResponse(templateFileName string, responseCode int, tpd templatePag
 
 	t, err := template.ParseGlob(filepath.Join(TemplatePath, "*.html"))
 	if err != nil {
-		log.Fatalf("Cannot parse templates: %#v", err)
+		log.Printf("Cannot parse templates: %s", err)
 		return nil, err
 	}
 
@@ -76,20 +82,51 @@ func RedirectResponse(response *http.Response, status int, url string) {
 	response.Header.Add("Location", url)
 }
 
+// pageResponse returns the template page, or a plain text page if the templates are broken
+// so there's always a response to send
+func pageResponse(templateFileName string, status int, tpd templatePageData) *http.Response {
+	t, err := TemplateResponse(templateFileName, status, tpd)
+	if err == nil {
+		return t
+	}
+
+	response := EmptyHTTPResponse(nil)
+	response.Status = http.StatusText(status)
+	response.StatusCode = status
+	response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	response.Body = ioutil.NopCloser(strings.NewReader(strings.TrimSpace(tpd.Title + "\n" + tpd.ErrorText)))
+	return response
+}
+
 func HTTPErrorResponse(err error) *http.Response {
 	tpd := NewTemplatePageData()
 	tpd.Title = "Error"
 	tpd.ErrorText = err.Error()
-	t, _ := TemplateResponse("error.html", http.StatusInternalServerError, tpd)
-	return t
+	return pageResponse("error.html", http.StatusInternalServerError, tpd)
+}
+
+// HTTPStatusResponse returns the error page with a title, message and status code
+func HTTPStatusResponse(status int, title string, err error) *http.Response {
+	tpd := NewTemplatePageData()
+	tpd.Title = title
+	if err != nil {
+		tpd.ErrorText = err.Error()
+	}
+	return pageResponse("error.html", status, tpd)
 }
 
 func HTTPNotFoundResponse(err error) *http.Response {
 	tpd := NewTemplatePageData()
 	tpd.Title = "Not Found"
 	tpd.ErrorText = "Element not found"
-	t, _ := TemplateResponse("error.html", http.StatusNotFound, tpd)
-	return t
+	return pageResponse("error.html", http.StatusNotFound, tpd)
+}
+
+// HTTPForbiddenResponse returns the page for users who are logged in but not allowed
+func HTTPForbiddenResponse() *http.Response {
+	tpd := NewTemplatePageData()
+	tpd.Title = "Forbidden"
+	return pageResponse("forbidden.html", http.StatusForbidden, tpd)
 }
 
 func AddSecurityHeaders(request *http.Request, response *http.Response) {
@@ -125,12 +162,18 @@ func addSecurityHeader(response *http.Response, header string, defaultStr string
 }
 
 func RemoveCookie(response *http.Response, cookieName string) {
+	RemoveDomainCookie(response, cookieName, "")
+}
+
+// RemoveDomainCookie expires a cookie which was set with a Domain attribute
+func RemoveDomainCookie(response *http.Response, cookieName string, domain string) {
 	expiryTime := time.Now().AddDate(-1, -1, -1)
 	cookie := &http.Cookie{
 		Name:     cookieName,
 		Value:    "",
 		Expires:  expiryTime,
 		Path:     "/",
+		Domain:   domain,
 		MaxAge:   -1,
 		HttpOnly: true,
 		Secure:   true,
@@ -151,3 +194,48 @@ func RedirectCookieURI(request *http.Request, response *http.Response, cookieNam
 
 	return redirectPath
 }
+
+// GenerateStateOauthCookie sets a random state cookie on the response and returns the state
+func GenerateStateOauthCookie(resp *http.Response) string {
+	var expiration = time.Now().Add(365 * 24 * time.Hour)
+
+	b, err := u.GenerateRandomBytes(16, true)
+	if err != nil {
+		panic(fmt.Sprintf("generateRandomBytes is unavailable: failed with %#v", err))
+	}
+
+	state := string(b)
+	cookie := http.Cookie{
+		Name:     StateCookieName,
+		Value:    state,
+		Expires:  expiration,
+		HttpOnly: true,
+		Secure:   true,
+	}
+
+	resp.Header.Add("Set-Cookie", cookie.String())
+
+	return state
+}
+
+// ValidStateOauthCookie returns true if the request "state" value matches the state cookie
+func ValidStateOauthCookie(request *http.Request) bool {
+	oauthState, err := request.Cookie(StateCookieName)
+	if err != nil {
+		return false
+	}
+	return oauthState.Value != "" && request.FormValue("state") == oauthState.Value
+}
+
+// WriteResponse writes a response to a http.ResponseWriter, for responses made outside of
+// a RoundTripper
+func WriteResponse(w http.ResponseWriter, response *http.Response) {
+	for k, v := range response.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(response.StatusCode)
+	if response.Body != nil {
+		io.Copy(w, response.Body)
+		response.Body.Close()
+	}
+}
@@ -14,7 +14,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	s "authenticating-route-service/internal/httphelper"
+	s "github.com/OllieJC/authenticating-route-service/internal/httphelper"
 )
 
 func parseCookieTime(rawCookieStr string) (time.Time, error) {
@@ -64,6 +64,18 @@ var _ = Describe("HTTPHelper", func() {
 		Expect(string(bodyBytes)).ToNot(ContainSubstring(errStr))
 	})
 
+	It("should return a plain text page when the templates can't be parsed", func() {
+		defer func(path string) { s.TemplatePath = path }(s.TemplatePath)
+		s.TemplatePath = "../../web/missing"
+
+		response := s.HTTPStatusResponse(http.StatusBadGateway, "Bad Gateway", errors.New("Test error."))
+		Expect(response.StatusCode).To(Equal(http.StatusBadGateway))
+
+		bodyBytes, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bodyBytes)).To(Equal("Bad Gateway\nTest error."))
+	})
+
 	It("should add sensible security header defaults with AddSecurityHeaders", func() {
 
 		request := httptest.NewRequest("GET", "http://testing.uk/", nil)
@@ -0,0 +1,53 @@
+package httphelper
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrBodyTooLarge is returned by a LimitedBody once more than its limit has been read
+var ErrBodyTooLarge = errors.New("Request body too large")
+
+// LimitedBody streams a request body, returning ErrBodyTooLarge if it is longer than the limit
+type LimitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+// NewLimitedBody wraps the body so no more than limit bytes can be read from it
+func NewLimitedBody(body io.ReadCloser, limit int64) *LimitedBody {
+	return &LimitedBody{body: body, remaining: limit}
+}
+
+// Read reads from the body until the limit is exceeded
+func (lb *LimitedBody) Read(p []byte) (int, error) {
+	if lb.exceeded {
+		return 0, ErrBodyTooLarge
+	}
+
+	// read one byte more than allowed to find out if the body is too large
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+
+	n, err := lb.body.Read(p)
+	if int64(n) > lb.remaining {
+		lb.exceeded = true
+		n = int(lb.remaining)
+		lb.remaining = 0
+		return n, ErrBodyTooLarge
+	}
+	lb.remaining -= int64(n)
+	return n, err
+}
+
+// Close closes the underlying body
+func (lb *LimitedBody) Close() error {
+	return lb.body.Close()
+}
+
+// Exceeded returns true once the body has been found to be longer than the limit
+func (lb *LimitedBody) Exceeded() bool {
+	return lb.exceeded
+}
@@ -0,0 +1,46 @@
+package httphelper_test
+
+import (
+	"io/ioutil"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+)
+
+var _ = Describe("LimitedBody", func() {
+	It("should read a body up to the limit", func() {
+		lb := s.NewLimitedBody(ioutil.NopCloser(strings.NewReader("0123456789")), 10)
+
+		b, err := ioutil.ReadAll(lb)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(b)).To(Equal("0123456789"))
+		Expect(lb.Exceeded()).To(BeFalse())
+	})
+
+	It("should return ErrBodyTooLarge for a body over the limit", func() {
+		lb := s.NewLimitedBody(ioutil.NopCloser(strings.NewReader("0123456789A")), 10)
+
+		b, err := ioutil.ReadAll(lb)
+		Expect(err).To(MatchError(s.ErrBodyTooLarge))
+		Expect(len(b)).To(BeNumerically("<=", 10))
+		Expect(lb.Exceeded()).To(BeTrue())
+
+		_, err = lb.Read(make([]byte, 1))
+		Expect(err).To(MatchError(s.ErrBodyTooLarge))
+	})
+
+	It("should limit a body read one byte at a time", func() {
+		lb := s.NewLimitedBody(ioutil.NopCloser(strings.NewReader("0123")), 2)
+
+		buf := make([]byte, 1)
+		for n := 0; n < 2; n++ {
+			_, err := lb.Read(buf)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := lb.Read(buf)
+		Expect(err).To(MatchError(s.ErrBodyTooLarge))
+	})
+})
@@ -0,0 +1,60 @@
+package httphelper
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsUpgradeRequest returns true for "Connection: Upgrade" requests such as WebSockets
+func IsUpgradeRequest(request *http.Request) bool {
+	for _, v := range request.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.ToLower(strings.TrimSpace(token)) == "upgrade" {
+				return request.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+type expiringConn struct {
+	io.ReadWriteCloser
+	closed chan struct{}
+	once   sync.Once
+	err    error
+}
+
+func (ec *expiringConn) Close() error {
+	ec.once.Do(func() {
+		close(ec.closed)
+		ec.err = ec.ReadWriteCloser.Close()
+	})
+	return ec.err
+}
+
+// CloseUpgradeAt closes the tunnel of a "101 Switching Protocols" response at the time
+func CloseUpgradeAt(response *http.Response, at time.Time) {
+	if response == nil || response.StatusCode != http.StatusSwitchingProtocols {
+		return
+	}
+
+	conn, ok := response.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	ec := &expiringConn{ReadWriteCloser: conn, closed: make(chan struct{})}
+	timer := time.NewTimer(time.Until(at))
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			ec.Close()
+		case <-ec.closed:
+		}
+	}()
+	response.Body = ec
+}
@@ -0,0 +1,52 @@
+package httphelper_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+)
+
+var _ = Describe("Upgrade", func() {
+	It("should detect upgrade requests", func() {
+		request := httptest.NewRequest("GET", "http://example.local/", nil)
+		Expect(s.IsUpgradeRequest(request)).To(BeFalse())
+
+		request.Header.Set("Connection", "keep-alive, Upgrade")
+		Expect(s.IsUpgradeRequest(request)).To(BeFalse())
+
+		request.Header.Set("Upgrade", "websocket")
+		Expect(s.IsUpgradeRequest(request)).To(BeTrue())
+	})
+
+	It("should close a switched connection at the time", func() {
+		client, server := net.Pipe()
+		defer server.Close()
+
+		response := &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: client}
+		s.CloseUpgradeAt(response, time.Now().Add(50*time.Millisecond))
+
+		go server.Write([]byte("hi"))
+		buf := make([]byte, 2)
+		_, err := io.ReadFull(response.Body, buf)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = server.Read(buf)
+		Expect(err).To(Equal(io.EOF))
+	})
+
+	It("should leave other responses alone", func() {
+		body := ioutil.NopCloser(strings.NewReader("hi"))
+		response := &http.Response{StatusCode: http.StatusOK, Body: body}
+		s.CloseUpgradeAt(response, time.Now())
+		Expect(response.Body).To(BeIdenticalTo(body))
+	})
+})
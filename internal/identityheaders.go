@@ -0,0 +1,95 @@
+package internal
+
+import (
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	"net/http"
+	"strings"
+)
+
+const noSetIdentityOpt = "NO-SET"
+
+// defaultIdentityHeaders are the headers sent to the backend, the names can be
+// changed per domain with "identity_headers" or disabled with "NO-SET"
+var defaultIdentityHeaders = map[string]string{
+	"email":    "X-Auth-Email",
+	"user":     "X-Auth-User",
+	"name":     "X-Auth-Name",
+	"provider": "X-Auth-Provider",
+	"groups":   "X-Auth-Groups",
+}
+
+func identityHeaderName(dc c.DomainConfig, key string) string {
+	for k, v := range dc.IdentityHeaders {
+		if strings.ToLower(k) == key && v != "" {
+			if v == noSetIdentityOpt {
+				return ""
+			}
+			return v
+		}
+	}
+	return defaultIdentityHeaders[key]
+}
+
+// sanitiseHeaderValue removes characters which aren't allowed in a header value
+func sanitiseHeaderValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// StripIdentityHeaders removes any client supplied copies of the identity headers
+func StripIdentityHeaders(request *http.Request) {
+	dc, _ := c.GetDomainConfigFromRequest(request)
+
+	for key, name := range defaultIdentityHeaders {
+		request.Header.Del(name)
+		if configured := identityHeaderName(dc, key); configured != "" {
+			request.Header.Del(configured)
+		}
+	}
+	for _, name := range dc.IdentityHeaders {
+		if name != noSetIdentityOpt {
+			request.Header.Del(name)
+		}
+	}
+}
+
+// SetIdentityHeaders strips client supplied identity headers from the request to the
+// backend and, if the session is valid, adds the session's identity
+func SetIdentityHeaders(request *http.Request, sess CustomSession, authenticated bool) {
+	StripIdentityHeaders(request)
+
+	if !authenticated {
+		return
+	}
+
+	dc, _ := c.GetDomainConfigFromRequest(request)
+	addIdentityHeaders(request.Header, dc, sess)
+}
+
+// addIdentityHeaders adds the session's identity to the headers, using the domain's names
+func addIdentityHeaders(header http.Header, dc c.DomainConfig, sess CustomSession) {
+	ident, ok := GetIdentity(sess)
+	if !ok {
+		return
+	}
+
+	values := map[string]string{
+		"email":    ident.Email,
+		"user":     ident.User,
+		"name":     ident.Name,
+		"provider": ident.Provider,
+		"groups":   strings.Join(ident.Groups, ","),
+	}
+
+	for key, val := range values {
+		name := identityHeaderName(dc, key)
+		val = sanitiseHeaderValue(val)
+		if name != "" && val != "" {
+			header.Set(name, val)
+		}
+	}
+}
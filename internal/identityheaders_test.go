@@ -0,0 +1,72 @@
+package internal_test
+
+import (
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal"
+)
+
+var _ = Describe("IdentityHeaders", func() {
+	githubSession := func() s.CustomSession {
+		sess := s.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "name": "Mona\r\nX-Injected: 1", "email": "octocat@email.example.local", "organisations": ["example-org"], "teams": ["example-org/admins"]}`
+		return sess
+	}
+
+	It("should set the identity headers using the domain's header names", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+
+		s.SetIdentityHeaders(request, githubSession(), true)
+
+		Expect(request.Header.Get("X-Auth-Email")).To(Equal("octocat@email.example.local"))
+		Expect(request.Header.Get("X-Auth-User")).To(Equal("octocat"))
+		Expect(request.Header.Get("X-Auth-Name")).To(Equal("MonaX-Injected: 1"))
+		Expect(request.Header.Get("X-Auth-Teams")).To(Equal("example-org,example-org/admins"))
+		Expect(request.Header.Get("X-Auth-Groups")).To(BeEmpty())
+	})
+
+	It("should not set a header configured as NO-SET", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+
+		s.SetIdentityHeaders(request, githubSession(), true)
+
+		Expect(request.Header.Get("X-Auth-Provider")).To(BeEmpty())
+	})
+
+	It("should use the default header names for a domain without identity_headers", func() {
+		request := httptest.NewRequest("GET", "http://unconfigured.local/anything", nil)
+
+		s.SetIdentityHeaders(request, githubSession(), true)
+
+		Expect(request.Header.Get("X-Auth-Provider")).To(Equal("github"))
+		Expect(request.Header.Get("X-Auth-Groups")).To(Equal("example-org,example-org/admins"))
+	})
+
+	It("should strip client supplied identity headers", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+		request.Header.Set("X-Auth-Email", "spoofed@email.example.local")
+		request.Header.Set("X-Auth-Provider", "spoofed")
+		request.Header.Set("X-Auth-Groups", "spoofed")
+		request.Header.Set("X-Auth-Teams", "spoofed")
+
+		s.SetIdentityHeaders(request, s.NewCustomSession(), false)
+
+		Expect(request.Header.Get("X-Auth-Email")).To(BeEmpty())
+		Expect(request.Header.Get("X-Auth-Provider")).To(BeEmpty())
+		Expect(request.Header.Get("X-Auth-Groups")).To(BeEmpty())
+		Expect(request.Header.Get("X-Auth-Teams")).To(BeEmpty())
+	})
+
+	It("should replace client supplied identity headers for an authenticated session", func() {
+		request := httptest.NewRequest("GET", "http://example.local/anything", nil)
+		request.Header.Set("X-Auth-Email", "spoofed@email.example.local")
+
+		s.SetIdentityHeaders(request, githubSession(), true)
+
+		Expect(request.Header.Values("X-Auth-Email")).To(Equal([]string{"octocat@email.example.local"}))
+	})
+})
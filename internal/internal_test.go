@@ -1,8 +1,8 @@
 package internal_test
 
 import (
-	s "authenticating-route-service/internal"
-	h "authenticating-route-service/internal/httphelper"
+	s "github.com/OllieJC/authenticating-route-service/internal"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
 	"os"
 
 	. "github.com/onsi/ginkgo"
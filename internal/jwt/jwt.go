@@ -0,0 +1,249 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformed        error = errors.New("malformed token")
+	errUnsupportedAlg   error = errors.New("unsupported signing algorithm")
+	errKeyTypeMismatch  error = errors.New("key type does not match signing algorithm")
+	errBadSignature     error = errors.New("invalid token signature")
+	errUnsupportedKey   error = errors.New("unsupported key type")
+	errMalformedJWKData error = errors.New("malformed key data")
+)
+
+// Header is the JOSE header of a token
+type Header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid,omitempty"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// Claims is the decoded payload of a token
+type Claims map[string]interface{}
+
+// Token is a parsed, but not yet verified, compact JWS
+type Token struct {
+	Header       Header
+	Claims       Claims
+	Raw          string
+	signingInput string
+	signature    []byte
+}
+
+// Parse decodes a compact serialised token without verifying it
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errMalformed
+	}
+
+	t := &Token{Raw: raw, signingInput: parts[0] + "." + parts[1]}
+
+	hb, err := b64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformed
+	}
+	if err = json.Unmarshal(hb, &t.Header); err != nil {
+		return nil, errMalformed
+	}
+
+	cb, err := b64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errMalformed
+	}
+	if err = json.Unmarshal(cb, &t.Claims); err != nil {
+		return nil, errMalformed
+	}
+
+	t.signature, err = b64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformed
+	}
+
+	return t, nil
+}
+
+func hashFor(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "ES512":
+		return crypto.SHA512, nil
+	}
+	return 0, errUnsupportedAlg
+}
+
+func digest(hash crypto.Hash, data string) []byte {
+	switch hash {
+	case crypto.SHA384:
+		h := sha512.Sum384([]byte(data))
+		return h[:]
+	case crypto.SHA512:
+		h := sha512.Sum512([]byte(data))
+		return h[:]
+	}
+	h := sha256.Sum256([]byte(data))
+	return h[:]
+}
+
+// Verify checks the token signature with the given public key
+func (t *Token) Verify(key crypto.PublicKey) error {
+	hash, err := hashFor(t.Header.Algorithm)
+	if err != nil {
+		return err
+	}
+	hashed := digest(hash, t.signingInput)
+
+	switch t.Header.Algorithm[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errKeyTypeMismatch
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, hashed, t.signature) != nil {
+			return errBadSignature
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errKeyTypeMismatch
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(t.signature) != 2*size {
+			return errBadSignature
+		}
+		r := new(big.Int).SetBytes(t.signature[:size])
+		s := new(big.Int).SetBytes(t.signature[size:])
+		if !ecdsa.Verify(pub, hashed, r, s) {
+			return errBadSignature
+		}
+	}
+
+	return nil
+}
+
+// String returns a string claim, or "" if it is missing
+func (c Claims) String(name string) string {
+	if v, ok := c[name].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// Audience returns the "aud" claim, which may be a string or an array
+func (c Claims) Audience() []string {
+	switch v := c["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var res []string
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// Time returns a NumericDate claim such as "exp"
+func (c Claims) Time(name string) (time.Time, bool) {
+	if v, ok := c[name].(float64); ok {
+		return time.Unix(int64(v), 0), true
+	}
+	return time.Time{}, false
+}
+
+// JWK is a single JSON Web Key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Key returns the key with the matching key ID
+func (s JWKS) Key(kid string) (JWK, bool) {
+	for _, k := range s.Keys {
+		if k.KeyID == kid {
+			return k, true
+		}
+	}
+	return JWK{}, false
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := b64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errMalformedJWKData
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// PublicKey returns the RSA or ECDSA public key held in the JWK
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errMalformedJWKData
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errUnsupportedKey
+}
@@ -0,0 +1,138 @@
+package jwt_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+)
+
+func encodeSegment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return b64.RawURLEncoding.EncodeToString(b)
+}
+
+func signRS256(key *rsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	input := encodeSegment(header) + "." + encodeSegment(claims)
+	hashed := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	return input + "." + b64.RawURLEncoding.EncodeToString(sig)
+}
+
+func signES256(key *ecdsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	input := encodeSegment(header) + "." + encodeSegment(claims)
+	hashed := sha256.Sum256([]byte(input))
+	r, s, _ := ecdsa.Sign(rand.Reader, key, hashed[:])
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return input + "." + b64.RawURLEncoding.EncodeToString(sig)
+}
+
+func b64BigInt(i *big.Int) string {
+	return b64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+var _ = Describe("JWT", func() {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	claims := map[string]interface{}{
+		"iss": "https://issuer.example.local",
+		"aud": []string{"abc", "def"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	It("should parse and verify an RS256 token", func() {
+		raw := signRS256(rsaKey, map[string]interface{}{"alg": "RS256", "kid": "one"}, claims)
+
+		t, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Header.KeyID).To(Equal("one"))
+		Expect(t.Claims.String("iss")).To(Equal("https://issuer.example.local"))
+		Expect(t.Claims.Audience()).To(Equal([]string{"abc", "def"}))
+
+		exp, ok := t.Claims.Time("exp")
+		Expect(ok).To(BeTrue())
+		Expect(exp).To(BeTemporally(">", time.Now()))
+
+		Expect(t.Verify(&rsaKey.PublicKey)).To(Succeed())
+	})
+
+	It("should parse and verify an ES256 token", func() {
+		raw := signES256(ecKey, map[string]interface{}{"alg": "ES256"}, claims)
+
+		t, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Verify(&ecKey.PublicKey)).To(Succeed())
+	})
+
+	It("should reject a tampered token", func() {
+		raw := signRS256(rsaKey, map[string]interface{}{"alg": "RS256"}, claims)
+		other := signRS256(rsaKey, map[string]interface{}{"alg": "RS256"}, map[string]interface{}{"iss": "evil"})
+
+		t, err := j.Parse(raw[:len(raw)-10] + other[len(other)-10:])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Verify(&rsaKey.PublicKey)).NotTo(Succeed())
+	})
+
+	It("should reject a key which does not match the algorithm", func() {
+		raw := signRS256(rsaKey, map[string]interface{}{"alg": "RS256"}, claims)
+
+		t, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Verify(&ecKey.PublicKey)).NotTo(Succeed())
+	})
+
+	It("should reject unsigned tokens", func() {
+		raw := encodeSegment(map[string]interface{}{"alg": "none"}) + "." + encodeSegment(claims) + "."
+
+		t, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(t.Verify(&rsaKey.PublicKey)).NotTo(Succeed())
+	})
+
+	It("should not parse malformed tokens", func() {
+		_, err := j.Parse("not.a-token")
+		Expect(err).To(HaveOccurred())
+
+		_, err = j.Parse("!!!.???.***")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should return public keys from a JWKS", func() {
+		set := j.JWKS{Keys: []j.JWK{
+			{KeyType: "RSA", KeyID: "rsa", N: b64BigInt(rsaKey.N), E: b64BigInt(big.NewInt(int64(rsaKey.E)))},
+			{KeyType: "EC", KeyID: "ec", Curve: "P-256", X: b64BigInt(ecKey.X), Y: b64BigInt(ecKey.Y)},
+		}}
+
+		k, ok := set.Key("rsa")
+		Expect(ok).To(BeTrue())
+		pub, err := k.PublicKey()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pub.(*rsa.PublicKey).N).To(Equal(rsaKey.N))
+
+		k, ok = set.Key("ec")
+		Expect(ok).To(BeTrue())
+		pub, err = k.PublicKey()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pub.(*ecdsa.PublicKey).X).To(Equal(ecKey.X))
+
+		_, ok = set.Key("missing")
+		Expect(ok).To(BeFalse())
+
+		_, err = j.JWK{KeyType: "oct"}.PublicKey()
+		Expect(err).To(HaveOccurred())
+	})
+})
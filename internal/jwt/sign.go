@@ -0,0 +1,147 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+)
+
+var errNoPEM error = errors.New("no PEM data found")
+
+// ParsePrivateKey reads an RSA or ECDSA private key from PKCS #1, SEC 1 or PKCS #8 PEM data
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errNoPEM
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, errUnsupportedKey
+}
+
+// DefaultAlgorithm returns the algorithm to sign with for the key, RS256 for RSA
+// keys and ES256, ES384 or ES512 for ECDSA keys depending on the curve
+func DefaultAlgorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		case elliptic.P521():
+			return "ES512", nil
+		}
+	}
+	return "", errUnsupportedKey
+}
+
+// Sign returns a compact serialised token of the claims signed by the key
+func Sign(claims Claims, alg string, kid string, key crypto.Signer) (string, error) {
+	hash, err := hashFor(alg)
+	if err != nil {
+		return "", err
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return "", errKeyTypeMismatch
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return "", errKeyTypeMismatch
+		}
+	default:
+		return "", errUnsupportedKey
+	}
+
+	hb, err := json.Marshal(Header{Algorithm: alg, KeyID: kid, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.RawURLEncoding.EncodeToString(hb) + "." + b64.RawURLEncoding.EncodeToString(cb)
+	hashed := digest(hash, input)
+
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		// JWS uses the fixed size r || s form rather than ASN.1
+		r, s, err := ecdsa.Sign(rand.Reader, k, hashed)
+		if err != nil {
+			return "", err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig = make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+	default:
+		sig, err = key.Sign(rand.Reader, hashed, hash)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return input + "." + b64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+func encodeBigInt(n *big.Int, size int) string {
+	b := n.Bytes()
+	if size > len(b) {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return b64.RawURLEncoding.EncodeToString(b)
+}
+
+// NewJWK returns the public JWK for an RSA or ECDSA key
+func NewJWK(key crypto.PublicKey, kid string, alg string) (JWK, error) {
+	k := JWK{KeyID: kid, Use: "sig", Algorithm: alg}
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		k.KeyType = "RSA"
+		k.N = encodeBigInt(pub.N, 0)
+		k.E = encodeBigInt(big.NewInt(int64(pub.E)), 0)
+	case *ecdsa.PublicKey:
+		k.KeyType = "EC"
+		k.Curve = pub.Curve.Params().Name
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k.X = encodeBigInt(pub.X, size)
+		k.Y = encodeBigInt(pub.Y, size)
+	default:
+		return k, errUnsupportedKey
+	}
+
+	return k, nil
+}
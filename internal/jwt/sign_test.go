@@ -0,0 +1,94 @@
+package jwt_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+)
+
+var _ = Describe("Sign", func() {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	claims := j.Claims{"sub": "user-1", "groups": []string{"admins"}}
+
+	It("should sign RS256 tokens which verify with the JWK", func() {
+		raw, err := j.Sign(claims, "RS256", "rsa-1", rsaKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		token, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Header.KeyID).To(Equal("rsa-1"))
+		Expect(token.Claims.String("sub")).To(Equal("user-1"))
+
+		jwk, err := j.NewJWK(rsaKey.Public(), "rsa-1", "RS256")
+		Expect(err).NotTo(HaveOccurred())
+		pub, err := jwk.PublicKey()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Verify(pub)).To(Succeed())
+	})
+
+	It("should sign ES256 tokens which verify with the JWK", func() {
+		raw, err := j.Sign(claims, "ES256", "ec-1", ecKey)
+		Expect(err).NotTo(HaveOccurred())
+
+		token, err := j.Parse(raw)
+		Expect(err).NotTo(HaveOccurred())
+
+		jwk, err := j.NewJWK(ecKey.Public(), "ec-1", "ES256")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(jwk.Curve).To(Equal("P-256"))
+		pub, err := jwk.PublicKey()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(token.Verify(pub)).To(Succeed())
+		Expect(token.Verify(rsaKey.Public())).NotTo(Succeed())
+	})
+
+	It("should not sign with a key which does not match the algorithm", func() {
+		_, err := j.Sign(claims, "ES256", "rsa-1", rsaKey)
+		Expect(err).To(HaveOccurred())
+
+		_, err = j.Sign(claims, "none", "rsa-1", rsaKey)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should return the default algorithm for a key", func() {
+		alg, err := j.DefaultAlgorithm(rsaKey.Public())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alg).To(Equal("RS256"))
+
+		alg, err = j.DefaultAlgorithm(ecKey.Public())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alg).To(Equal("ES256"))
+	})
+
+	It("should parse PKCS #1, SEC 1 and PKCS #8 private keys", func() {
+		pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+		key, err := j.ParsePrivateKey(pkcs1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Public()).To(Equal(rsaKey.Public()))
+
+		ecDER, _ := x509.MarshalECPrivateKey(ecKey)
+		sec1 := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})
+		key, err = j.ParsePrivateKey(sec1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Public()).To(Equal(ecKey.Public()))
+
+		pkcs8DER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+		pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8DER})
+		key, err = j.ParsePrivateKey(pkcs8)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key.Public()).To(Equal(ecKey.Public()))
+
+		_, err = j.ParsePrivateKey([]byte("not a key"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,342 @@
+package oidc
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+	u "github.com/OllieJC/authenticating-route-service/internal/utils"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+
+	"golang.org/x/oauth2"
+)
+
+// ProviderString is OpenID Connect
+const ProviderString = "oidc"
+const nonceCookieName = "oauthnonce"
+
+const (
+	discoveryTTL     = time.Hour
+	jwksTTL          = time.Hour
+	jwksMinRefresh   = time.Minute
+	clockSkewLeeway  = time.Minute
+	wellKnownSuffix  = "/.well-known/openid-configuration"
+	maxDocumentBytes = 1 << 20
+)
+
+var (
+	// HTTPClient is used for discovery and JWKS requests, can be adjusted for testing
+	HTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	errNoIssuer       error = errors.New("no issuer configured")
+	errNoIDToken      error = errors.New("no id_token in token response")
+	errBadIssuer      error = errors.New("id_token issuer mismatch")
+	errBadAudience    error = errors.New("id_token audience mismatch")
+	errExpired        error = errors.New("id_token expired")
+	errBadNonce       error = errors.New("id_token nonce mismatch")
+	errUnknownKey     error = errors.New("id_token signed with unknown key")
+	errNoneAlgorithm  error = errors.New("id_token is not signed")
+	errIssuerMismatch error = errors.New("discovery document issuer mismatch")
+)
+
+var defaultScopes = []string{"openid", "email", "profile"}
+
+// Discovery is the subset of the OpenID Provider metadata that is used
+type Discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+type cachedDiscovery struct {
+	doc     Discovery
+	expires time.Time
+}
+
+type cachedJWKS struct {
+	keys    map[string]crypto.PublicKey
+	expires time.Time
+	fetched time.Time
+}
+
+var (
+	cacheMu        sync.Mutex
+	discoveryCache = map[string]cachedDiscovery{}
+	jwksCache      = map[string]*cachedJWKS{}
+)
+
+func getDocument(url string, v interface{}) error {
+	response, err := HTTPClient.Get(url)
+	if err != nil {
+		return fmt.Errorf("failed getting %s: %s", url, err.Error())
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed getting %s: status %d", url, response.StatusCode)
+	}
+
+	contents, err := ioutil.ReadAll(io.LimitReader(response.Body, maxDocumentBytes))
+	if err != nil {
+		return fmt.Errorf("failed read response: %s", err.Error())
+	}
+
+	return json.Unmarshal(contents, v)
+}
+
+// GetDiscovery returns the (cached) discovery document for an issuer
+func GetDiscovery(issuer string) (Discovery, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	if issuer == "" {
+		return Discovery{}, errNoIssuer
+	}
+
+	cacheMu.Lock()
+	cd, ok := discoveryCache[issuer]
+	cacheMu.Unlock()
+	if ok && time.Now().Before(cd.expires) {
+		return cd.doc, nil
+	}
+
+	Debugfln("GetDiscovery: Fetching discovery document for %s", issuer)
+
+	var doc Discovery
+	if err := getDocument(issuer+wellKnownSuffix, &doc); err != nil {
+		return Discovery{}, err
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != issuer {
+		return Discovery{}, errIssuerMismatch
+	}
+
+	cacheMu.Lock()
+	discoveryCache[issuer] = cachedDiscovery{doc: doc, expires: time.Now().Add(discoveryTTL)}
+	cacheMu.Unlock()
+
+	return doc, nil
+}
+
+// getKey returns a signing key from the (cached) JWKS, refreshing it if the key ID is unknown
+func getKey(jwksURI string, kid string) (crypto.PublicKey, error) {
+	cacheMu.Lock()
+	cj, ok := jwksCache[jwksURI]
+	cacheMu.Unlock()
+
+	if ok {
+		key, found := cj.keys[kid]
+		stale := time.Now().After(cj.expires)
+		canRefresh := time.Now().After(cj.fetched.Add(jwksMinRefresh))
+		if found && !stale {
+			return key, nil
+		}
+		if !found && !stale && !canRefresh {
+			return nil, errUnknownKey
+		}
+	}
+
+	Debugfln("getKey: Fetching JWKS from %s", jwksURI)
+
+	var set j.JWKS
+	if err := getDocument(jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			Debugfln("getKey: skipping key %s: %s", k.KeyID, err.Error())
+			continue
+		}
+		keys[k.KeyID] = pub
+	}
+
+	now := time.Now()
+	cacheMu.Lock()
+	jwksCache[jwksURI] = &cachedJWKS{keys: keys, expires: now.Add(jwksTTL), fetched: now}
+	cacheMu.Unlock()
+
+	if key, found := keys[kid]; found {
+		return key, nil
+	}
+	return nil, errUnknownKey
+}
+
+// oauthConfig returns the config for the email domain's issuer and its discovery document
+func oauthConfig(dc c.DomainConfig, emailDomain string) (*oauth2.Config, Discovery, error) {
+	led := dc.GetLoginEmailDomain(emailDomain, ProviderString)
+
+	doc, err := GetDiscovery(led.Issuer)
+	if err != nil {
+		return nil, doc, err
+	}
+
+	scopes := defaultScopes
+	if len(led.Scopes) > 0 {
+		scopes = led.Scopes
+	}
+
+	endpoint := oauth2.Endpoint{
+		AuthURL:  doc.AuthorizationEndpoint,
+		TokenURL: doc.TokenEndpoint,
+	}
+	return p.OAuthConfig(dc, ProviderString, emailDomain, endpoint, scopes), doc, nil
+}
+
+func generateNonceCookie(resp *http.Response) (string, error) {
+	b, err := u.GenerateRandomBytes(16, true)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := string(b)
+	cookie := http.Cookie{
+		Name:     nonceCookieName,
+		Value:    nonce,
+		Expires:  time.Now().Add(1 * time.Hour),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+
+	return nonce, nil
+}
+
+// OAuthOIDCLogin redirects the response to the issuer's authorization endpoint
+func OAuthOIDCLogin(response *http.Response, dc c.DomainConfig, emailDomain string) error {
+	Debugfln("OAuthOIDCLogin:1: Start...")
+
+	conf, _, err := oauthConfig(dc, emailDomain)
+	if err != nil {
+		Debugfln("OAuthOIDCLogin:err: %#v", err)
+		return err
+	}
+
+	oauthState := h.GenerateStateOauthCookie(response)
+	nonce, err := generateNonceCookie(response)
+	if err != nil {
+		return err
+	}
+
+	oAuthUrl := conf.AuthCodeURL(oauthState, oauth2.SetAuthURLParam("nonce", nonce))
+
+	h.RedirectResponse(response, http.StatusSeeOther, oAuthUrl)
+
+	return nil
+}
+
+// OauthOIDCCallback exchanges the code and returns the validated ID token claims
+func OauthOIDCCallback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	Debugfln("OauthOIDCCallback:1: Start...")
+
+	if !h.ValidStateOauthCookie(request) {
+		Debugfln("OauthOIDCCallback:err: state bad")
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: state bad")
+	}
+
+	nonceCookie, err := request.Cookie(nonceCookieName)
+	if err != nil || nonceCookie.Value == "" {
+		Debugfln("OauthOIDCCallback:err: nonce missing")
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: nonce missing")
+	}
+	h.RemoveCookie(response, nonceCookieName)
+
+	escPath := request.URL.EscapedPath()
+	sep := strings.Split(escPath, "/")
+	domain := strings.ToLower(sep[len(sep)-1])
+
+	conf, doc, err := oauthConfig(dc, domain)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: %s", err.Error())
+	}
+
+	token, err := conf.Exchange(oauth2.NoContext, request.FormValue("code"))
+	if err != nil {
+		Debugfln("OauthOIDCCallback:err: %#v", err)
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: code exchange wrong: %s", err.Error())
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: %s", errNoIDToken.Error())
+	}
+
+	claims, err := ValidateIDToken(rawIDToken, doc, conf.ClientID, nonceCookie.Value)
+	if err != nil {
+		Debugfln("OauthOIDCCallback:err: %#v", err)
+		return "", fmt.Errorf("ERROR: OauthOIDCCallback: %s", err.Error())
+	}
+
+	Debugfln("OauthOIDCCallback:2: Valid id_token for %s", claims.String("sub"))
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// ValidateIDToken checks the signature, issuer, audience, expiry and nonce of an ID token
+func ValidateIDToken(rawIDToken string, doc Discovery, clientID string, nonce string) (j.Claims, error) {
+	t, err := j.Parse(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Header.Algorithm == "" || strings.ToLower(t.Header.Algorithm) == "none" {
+		return nil, errNoneAlgorithm
+	}
+
+	key, err := getKey(doc.JWKSURI, t.Header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.Verify(key); err != nil {
+		return nil, err
+	}
+
+	if t.Claims.String("iss") != doc.Issuer {
+		return nil, errBadIssuer
+	}
+
+	aud := t.Claims.Audience()
+	audOK := false
+	for _, a := range aud {
+		if a == clientID {
+			audOK = true
+			break
+		}
+	}
+	if !audOK || (len(aud) > 1 && t.Claims.String("azp") != "" && t.Claims.String("azp") != clientID) {
+		return nil, errBadAudience
+	}
+
+	exp, ok := t.Claims.Time("exp")
+	if !ok || time.Now().Add(-clockSkewLeeway).After(exp) {
+		return nil, errExpired
+	}
+
+	if t.Claims.String("nonce") != nonce {
+		return nil, errBadNonce
+	}
+
+	return t.Claims, nil
+}
@@ -0,0 +1,277 @@
+package oidc_test
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	o "github.com/OllieJC/authenticating-route-service/internal/oidc"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+type fakeIssuer struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	kid       string
+	claims    map[string]interface{}
+	jwksHits  int
+	signWith  *rsa.PrivateKey
+	tokenHits int
+}
+
+func encodeSegment(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return b64.RawURLEncoding.EncodeToString(b)
+}
+
+func (f *fakeIssuer) idToken() string {
+	input := encodeSegment(map[string]interface{}{"alg": "RS256", "kid": f.kid}) + "." + encodeSegment(f.claims)
+	hashed := sha256.Sum256([]byte(input))
+	key := f.key
+	if f.signWith != nil {
+		key = f.signWith
+	}
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	return input + "." + b64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newFakeIssuer() *fakeIssuer {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f := &fakeIssuer{key: key, kid: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.server.URL,
+			"authorization_endpoint": f.server.URL + "/authorize",
+			"token_endpoint":         f.server.URL + "/token",
+			"jwks_uri":               f.server.URL + "/jwks",
+			"end_session_endpoint":   f.server.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		f.jwksHits++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{"kty": "oct", "kid": "symmetric", "k": "c2VjcmV0"},
+				{
+					"kty": "RSA",
+					"kid": f.kid,
+					"use": "sig",
+					"n":   b64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   b64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.tokenHits++
+		r.ParseForm()
+		if r.FormValue("code") != "good" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"id_token":     f.idToken(),
+		})
+	})
+
+	f.server = httptest.NewServer(mux)
+	f.claims = map[string]interface{}{
+		"iss":   f.server.URL,
+		"sub":   "user-1",
+		"aud":   "client-1",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": "the-nonce",
+		"email": "user@oidc.example.local",
+	}
+	return f
+}
+
+func callbackRequest(code string, nonce string) (*http.Request, *http.Response) {
+	response := h.EmptyHTTPResponse(nil)
+	state := h.GenerateStateOauthCookie(response)
+
+	path := "/auth/callback/oidc/oidc.example.local"
+	request, _ := http.NewRequest("GET", fmt.Sprintf("http://example.local%s", path), nil)
+	request.Header = http.Header{"Cookie": []string{response.Header.Get("Set-Cookie")}}
+	request.AddCookie(&http.Cookie{Name: "oauthnonce", Value: nonce})
+	request.Form = url.Values{}
+	request.Form.Add("state", state)
+	request.Form.Add("code", code)
+
+	return request, h.EmptyHTTPResponse(request)
+}
+
+var _ = Describe("OIDC", func() {
+	var (
+		fake *fakeIssuer
+		dc   c.DomainConfig
+	)
+
+	BeforeEach(func() {
+		fake = newFakeIssuer()
+		p.ResetOAuthConfigCaches()
+		dc = c.DomainConfig{
+			Domain: "example.local",
+			LoginEmailDomains: []c.LoginEmailDomain{
+				{
+					Domain:            "oidc.example.local",
+					Provider:          "oidc",
+					OAuthClientID:     "client-1",
+					OAuthClientSecret: "secret-1",
+					Issuer:            fake.server.URL,
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		fake.server.Close()
+	})
+
+	It("should redirect to the discovered authorization endpoint with a nonce", func() {
+		r := h.EmptyHTTPResponse(nil)
+		err := o.OAuthOIDCLogin(r, dc, "oidc.example.local")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r.StatusCode).To(Equal(http.StatusSeeOther))
+
+		loc, err := r.Location()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loc.Path).To(Equal("/authorize"))
+		Expect(loc.Query().Get("client_id")).To(Equal("client-1"))
+		Expect(loc.Query().Get("scope")).To(Equal("openid email profile"))
+		Expect(loc.Query().Get("redirect_uri")).To(Equal("https://example.local/auth/callback/oidc/oidc.example.local"))
+
+		cookies := (&http.Response{Header: r.Header}).Cookies()
+		var nonce string
+		for _, ck := range cookies {
+			if ck.Name == "oauthnonce" {
+				nonce = ck.Value
+			}
+		}
+		Expect(nonce).NotTo(BeEmpty())
+		Expect(loc.Query().Get("nonce")).To(Equal(nonce))
+	})
+
+	It("should return an error when discovery fails", func() {
+		dc.LoginEmailDomains[0].Issuer = fake.server.URL + "/missing"
+
+		r := h.EmptyHTTPResponse(nil)
+		err := o.OAuthOIDCLogin(r, dc, "oidc.example.local")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should return the claims of a valid ID token", func() {
+		request, response := callbackRequest("good", "the-nonce")
+
+		cbResp, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).NotTo(HaveOccurred())
+
+		var claims map[string]interface{}
+		Expect(json.Unmarshal([]byte(cbResp), &claims)).To(Succeed())
+		Expect(claims["email"]).To(Equal("user@oidc.example.local"))
+		Expect(claims["sub"]).To(Equal("user-1"))
+	})
+
+	It("should cache the JWKS between callbacks", func() {
+		for n := 0; n < 3; n++ {
+			request, response := callbackRequest("good", "the-nonce")
+			_, err := o.OauthOIDCCallback(request, response, dc)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(fake.tokenHits).To(Equal(3))
+		Expect(fake.jwksHits).To(Equal(1))
+	})
+
+	It("should reject an ID token with the wrong nonce", func() {
+		request, response := callbackRequest("good", "another-nonce")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("nonce"))
+	})
+
+	It("should reject an ID token for another audience", func() {
+		fake.claims["aud"] = []string{"client-2", "client-3"}
+		request, response := callbackRequest("good", "the-nonce")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("audience"))
+	})
+
+	It("should reject an ID token from another issuer", func() {
+		fake.claims["iss"] = "https://evil.example.local"
+		request, response := callbackRequest("good", "the-nonce")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("issuer"))
+	})
+
+	It("should reject an expired ID token", func() {
+		fake.claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		request, response := callbackRequest("good", "the-nonce")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("expired"))
+	})
+
+	It("should reject an ID token with a bad signature", func() {
+		fake.signWith, _ = rsa.GenerateKey(rand.Reader, 2048)
+		request, response := callbackRequest("good", "the-nonce")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("signature"))
+	})
+
+	It("should reject a callback without a nonce cookie", func() {
+		request, response := callbackRequest("good", "")
+
+		_, err := o.OauthOIDCCallback(request, response, dc)
+		Expect(err).To(HaveOccurred())
+		Expect(fake.tokenHits).To(Equal(0))
+	})
+
+	It("should register as a provider and normalise the claims", func() {
+		idp, ok := p.Get(o.ProviderString)
+		Expect(ok).To(BeTrue())
+
+		fake.claims["preferred_username"] = "user.one"
+		fake.claims["groups"] = []string{"admins", "devs"}
+		request, response := callbackRequest("good", "the-nonce")
+		cbResp, err := idp.Callback(request, response, dc)
+		Expect(err).NotTo(HaveOccurred())
+
+		ident, err := idp.Identity(cbResp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ident.User).To(Equal("user.one"))
+		Expect(ident.Email).To(Equal("user@oidc.example.local"))
+		Expect(ident.Groups).To(Equal([]string{"admins", "devs"}))
+
+		logoutURL, err := url.Parse(idp.LogoutURL(dc, cbResp))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(logoutURL.Path).To(Equal("/logout"))
+		Expect(logoutURL.Query().Get("post_logout_redirect_uri")).To(Equal("https://example.local/auth/login"))
+	})
+})
@@ -0,0 +1,83 @@
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	j "github.com/OllieJC/authenticating-route-service/internal/jwt"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+type oidcProvider struct{}
+
+func init() {
+	p.Register(oidcProvider{})
+}
+
+func (oidcProvider) Name() string {
+	return ProviderString
+}
+
+func (oidcProvider) Login(request *http.Request, response *http.Response, dc c.DomainConfig, emailDomain string) error {
+	return OAuthOIDCLogin(response, dc, emailDomain)
+}
+
+func (oidcProvider) Callback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	return OauthOIDCCallback(request, response, dc)
+}
+
+// Identity reads the standard claims, and "groups" if the issuer sends it
+func (oidcProvider) Identity(userData string) (p.Identity, error) {
+	var claims j.Claims
+	if err := json.Unmarshal([]byte(userData), &claims); err != nil {
+		return p.Identity{}, err
+	}
+
+	user := claims.String("preferred_username")
+	if user == "" {
+		user = claims.String("sub")
+	}
+
+	var groups []string
+	if gs, ok := claims["groups"].([]interface{}); ok {
+		for _, g := range gs {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	return p.Identity{
+		Provider: ProviderString,
+		Email:    claims.String("email"),
+		User:     user,
+		Name:     claims.String("name"),
+		Groups:   groups,
+	}, nil
+}
+
+// LogoutURL returns the issuer's end_session_endpoint if it advertises one
+func (oidcProvider) LogoutURL(dc c.DomainConfig, userData string) string {
+	var claims j.Claims
+	if err := json.Unmarshal([]byte(userData), &claims); err != nil {
+		return ""
+	}
+
+	doc, err := GetDiscovery(claims.String("iss"))
+	if err != nil || doc.EndSessionEndpoint == "" {
+		return ""
+	}
+
+	u, err := url.Parse(doc.EndSessionEndpoint)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("post_logout_redirect_uri", fmt.Sprintf("https://%s/auth/login", dc.Domain))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
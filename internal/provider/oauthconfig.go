@@ -0,0 +1,82 @@
+package provider
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+
+	"golang.org/x/oauth2"
+)
+
+const redirectFormatString = "%s://%s/auth/callback/%s/%s"
+
+type oauthConfigKey struct {
+	provider    string
+	routeDomain string
+	emailDomain string
+}
+
+var (
+	oauthConfigsMu sync.RWMutex
+	oauthConfigs   = map[oauthConfigKey]*oauth2.Config{}
+)
+
+// the client IDs, secrets and redirect URLs may change when the config is reloaded
+func init() {
+	c.OnReload(ResetOAuthConfigCaches)
+}
+
+// OAuthConfig returns the provider's OAuth config for the email domain, with the redirect
+// URL for the request's hostname. The shared part is cached for the configured domain, so
+// a wildcard has one config for all its hosts.
+func OAuthConfig(dc c.DomainConfig, provider string, emailDomain string, endpoint oauth2.Endpoint, scopes []string) *oauth2.Config {
+	provider = strings.ToLower(provider)
+	key := oauthConfigKey{provider, strings.ToLower(dc.ConfiguredDomain()), strings.ToLower(emailDomain)}
+
+	oauthConfigsMu.RLock()
+	conf, ok := oauthConfigs[key]
+	oauthConfigsMu.RUnlock()
+
+	if !ok {
+		conf = &oauth2.Config{
+			Scopes:   scopes,
+			Endpoint: endpoint,
+		}
+		if emailDomain != "" {
+			led := dc.GetLoginEmailDomain(emailDomain, provider)
+			if led.Provider == provider {
+				conf.ClientID = led.OAuthClientID
+				conf.ClientSecret = led.OAuthClientSecret
+			}
+		}
+
+		oauthConfigsMu.Lock()
+		if cached, ok := oauthConfigs[key]; ok {
+			conf = cached
+		} else {
+			oauthConfigs[key] = conf
+		}
+		oauthConfigsMu.Unlock()
+	}
+
+	if emailDomain == "" || dc.Domain == "" {
+		return conf
+	}
+
+	// the cached config is shared between requests, so the redirect URL is set on a copy
+	withURL := *conf
+	withURL.RedirectURL = fmt.Sprintf(redirectFormatString, "https", dc.Domain, provider, emailDomain)
+	Debugfln("OAuthConfig: Setting RedirectURL to: %s", withURL.RedirectURL)
+	return &withURL
+}
+
+// ResetOAuthConfigCaches removes the cached configs, for when the config or an endpoint
+// changes
+func ResetOAuthConfigCaches() {
+	oauthConfigsMu.Lock()
+	oauthConfigs = map[oauthConfigKey]*oauth2.Config{}
+	oauthConfigsMu.Unlock()
+}
@@ -0,0 +1,83 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+)
+
+// Identity is the normalised identity of an authenticated user
+type Identity struct {
+	Provider string
+	Email    string
+	User     string
+	Name     string
+	Groups   []string
+}
+
+// Provider is an identity provider which users can log in with
+type Provider interface {
+	// Name is the provider string used in config and in /auth/callback/{provider}/... paths
+	Name() string
+
+	// Login adds a redirect to the provider's login page to the response
+	Login(request *http.Request, response *http.Response, dc c.DomainConfig, emailDomain string) error
+
+	// Callback handles the provider's redirect back and returns the user data to keep in the session
+	Callback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error)
+
+	// Identity normalises the user data returned by Callback
+	Identity(userData string) (Identity, error)
+
+	// LogoutURL returns where to send the user after logging out, or "" to use the login page
+	LogoutURL(dc c.DomainConfig, userData string) string
+}
+
+// ErrAccountMismatch is wrapped by Callback errors when the account returned by the
+// provider can't be used for the email domain the user logged in with, because it
+// belongs to another domain or isn't in an allowed organisation or team
+var ErrAccountMismatch = errors.New("account does not match the requested email domain")
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{}
+)
+
+// Register makes a provider available by name, it panics if the name is already registered
+func Register(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	name := strings.ToLower(p.Name())
+	if _, dup := providers[name]; dup {
+		panic(fmt.Sprintf("provider: Register called twice for %s", name))
+	}
+	providers[name] = p
+}
+
+// Get returns the provider registered with the name
+func Get(name string) (Provider, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	p, ok := providers[strings.ToLower(name)]
+	return p, ok
+}
+
+// Names returns the sorted names of the registered providers
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var res []string
+	for name := range providers {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
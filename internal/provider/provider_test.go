@@ -0,0 +1,99 @@
+package provider_test
+
+import (
+	"net/http"
+
+	"golang.org/x/oauth2"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	p "github.com/OllieJC/authenticating-route-service/internal/provider"
+)
+
+type fakeProvider struct {
+	name string
+}
+
+func (f fakeProvider) Name() string {
+	return f.name
+}
+
+func (f fakeProvider) Login(request *http.Request, response *http.Response, dc c.DomainConfig, emailDomain string) error {
+	return nil
+}
+
+func (f fakeProvider) Callback(request *http.Request, response *http.Response, dc c.DomainConfig) (string, error) {
+	return "user", nil
+}
+
+func (f fakeProvider) Identity(userData string) (p.Identity, error) {
+	return p.Identity{Provider: f.name, User: userData}, nil
+}
+
+func (f fakeProvider) LogoutURL(dc c.DomainConfig, userData string) string {
+	return ""
+}
+
+var _ = Describe("Provider", func() {
+	p.Register(fakeProvider{name: "Fake"})
+
+	It("should return a registered provider by name, ignoring case", func() {
+		idp, ok := p.Get("fake")
+		Expect(ok).To(BeTrue())
+		Expect(idp.Name()).To(Equal("Fake"))
+
+		ident, err := idp.Identity("abc")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ident.User).To(Equal("abc"))
+	})
+
+	It("should not return an unknown provider", func() {
+		_, ok := p.Get("unknown")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should list registered providers", func() {
+		Expect(p.Names()).To(ContainElement("fake"))
+	})
+
+	It("should panic when a name is registered twice", func() {
+		Expect(func() { p.Register(fakeProvider{name: "fake"}) }).To(Panic())
+	})
+
+	Context("when building OAuth configs", func() {
+		dc := c.DomainConfig{
+			Domain: "oauth.example.local",
+			LoginEmailDomains: []c.LoginEmailDomain{
+				{Domain: "email.local", Provider: "google", OAuthClientID: "google-client"},
+				{Domain: "email.local", Provider: "github", OAuthClientID: "github-client"},
+			},
+		}
+
+		BeforeEach(func() {
+			p.ResetOAuthConfigCaches()
+		})
+
+		It("should keep a config for each provider with the hostname's redirect URL", func() {
+			endpoint := oauth2.Endpoint{AuthURL: "https://idp.local/auth"}
+
+			conf := p.OAuthConfig(dc, "google", "email.local", endpoint, []string{"email"})
+			Expect(conf.ClientID).To(Equal("google-client"))
+			Expect(conf.RedirectURL).To(Equal("https://oauth.example.local/auth/callback/google/email.local"))
+			Expect(conf.Scopes).To(Equal([]string{"email"}))
+
+			conf = p.OAuthConfig(dc, "github", "email.local", endpoint, nil)
+			Expect(conf.ClientID).To(Equal("github-client"))
+			Expect(conf.RedirectURL).To(Equal("https://oauth.example.local/auth/callback/github/email.local"))
+		})
+
+		It("should build the config again once the caches are reset", func() {
+			first := p.OAuthConfig(dc, "google", "email.local", oauth2.Endpoint{AuthURL: "https://one.local/auth"}, nil)
+			Expect(p.OAuthConfig(dc, "google", "email.local", oauth2.Endpoint{AuthURL: "https://two.local/auth"}, nil).Endpoint).To(Equal(first.Endpoint))
+
+			p.ResetOAuthConfigCaches()
+			Expect(p.OAuthConfig(dc, "google", "email.local", oauth2.Endpoint{AuthURL: "https://two.local/auth"}, nil).Endpoint.AuthURL).To(Equal("https://two.local/auth"))
+		})
+	})
+})
@@ -0,0 +1,8 @@
+package internal
+
+import (
+	// Identity providers register themselves with the provider registry
+	_ "github.com/OllieJC/authenticating-route-service/internal/github"
+	_ "github.com/OllieJC/authenticating-route-service/internal/google"
+	_ "github.com/OllieJC/authenticating-route-service/internal/oidc"
+)
@@ -0,0 +1,176 @@
+package routeservice
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// SignatureHeader is the encrypted Signature added by the gorouter
+	SignatureHeader = "X-CF-Proxy-Signature"
+
+	// MetadataHeader holds the nonce used to encrypt the SignatureHeader
+	MetadataHeader = "X-CF-Proxy-Metadata"
+
+	// DefaultMaxSkew matches the gorouter's default route service timeout
+	DefaultMaxSkew = 60 * time.Second
+)
+
+var (
+	// ErrMalformedSignature is wrapped by errors for missing or undecodable headers
+	ErrMalformedSignature = errors.New("route service signature missing or malformed")
+
+	// ErrInvalidSignature is wrapped by errors for signatures which can't be decrypted,
+	// don't match the forwarded URL or have expired
+	ErrInvalidSignature = errors.New("route service signature invalid")
+)
+
+// Signature is the payload of the X-CF-Proxy-Signature header
+type Signature struct {
+	ForwardedURL  string    `json:"forwarded_url"`
+	RequestedTime time.Time `json:"requested_time"`
+}
+
+// Metadata is the payload of the X-CF-Proxy-Metadata header
+type Metadata struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// Verifier checks gorouter signatures using the shared route services secret
+type Verifier struct {
+	aeads   []cipher.AEAD
+	maxSkew time.Duration
+
+	// Now can be adjusted for testing
+	Now func() time.Time
+}
+
+// newAEAD derives the AES-GCM key from the secret in the same way as the gorouter
+func newAEAD(secret string) (cipher.AEAD, error) {
+	key := pbkdf2.Key([]byte(secret), nil, 100000, 16, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewVerifier returns a Verifier for the secrets, the first is the current secret and
+// any others are previous secrets which are still accepted while the secret is rotated.
+// A maxSkew of 0 uses DefaultMaxSkew.
+func NewVerifier(secrets []string, maxSkew time.Duration) (*Verifier, error) {
+	v := &Verifier{maxSkew: maxSkew, Now: time.Now}
+	if v.maxSkew <= 0 {
+		v.maxSkew = DefaultMaxSkew
+	}
+
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		aead, err := newAEAD(secret)
+		if err != nil {
+			return nil, err
+		}
+		v.aeads = append(v.aeads, aead)
+	}
+
+	if len(v.aeads) == 0 {
+		return nil, errors.New("no route service secret")
+	}
+	return v, nil
+}
+
+// Verify returns an error wrapping ErrMalformedSignature or ErrInvalidSignature unless
+// the headers are a signature of the forwarded URL made within the allowed skew
+func (v *Verifier) Verify(signatureHeader string, metadataHeader string, forwardedURL string) (Signature, error) {
+	var (
+		sig  Signature
+		meta Metadata
+	)
+
+	if signatureHeader == "" || metadataHeader == "" {
+		return sig, fmt.Errorf("missing %s or %s header: %w", SignatureHeader, MetadataHeader, ErrMalformedSignature)
+	}
+
+	metaJSON, err := b64.URLEncoding.DecodeString(metadataHeader)
+	if err != nil {
+		return sig, fmt.Errorf("decoding metadata: %w", ErrMalformedSignature)
+	}
+	if err = json.Unmarshal(metaJSON, &meta); err != nil {
+		return sig, fmt.Errorf("decoding metadata: %w", ErrMalformedSignature)
+	}
+
+	cipherText, err := b64.URLEncoding.DecodeString(signatureHeader)
+	if err != nil {
+		return sig, fmt.Errorf("decoding signature: %w", ErrMalformedSignature)
+	}
+
+	var plainText []byte
+	for _, aead := range v.aeads {
+		if len(meta.Nonce) != aead.NonceSize() {
+			return sig, fmt.Errorf("bad nonce size: %w", ErrMalformedSignature)
+		}
+		plainText, err = aead.Open(nil, meta.Nonce, cipherText, []byte{})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return sig, fmt.Errorf("decrypting signature: %w", ErrInvalidSignature)
+	}
+
+	if err = json.Unmarshal(plainText, &sig); err != nil {
+		return sig, fmt.Errorf("decoding signature: %w", ErrInvalidSignature)
+	}
+
+	if sig.ForwardedURL != forwardedURL {
+		return sig, fmt.Errorf("signed URL '%s' does not match '%s': %w", sig.ForwardedURL, forwardedURL, ErrInvalidSignature)
+	}
+
+	age := v.Now().Sub(sig.RequestedTime)
+	if age > v.maxSkew || age < -v.maxSkew {
+		return sig, fmt.Errorf("signature requested at %s is outside the allowed skew: %w", sig.RequestedTime, ErrInvalidSignature)
+	}
+
+	return sig, nil
+}
+
+// Sign returns the signature and metadata headers the gorouter would send for the
+// forwarded URL, it is used to test Verify
+func Sign(secret string, forwardedURL string, requestedTime time.Time) (string, string, error) {
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	sigJSON, err := json.Marshal(Signature{ForwardedURL: forwardedURL, RequestedTime: requestedTime})
+	if err != nil {
+		return "", "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", "", err
+	}
+
+	metaJSON, err := json.Marshal(Metadata{Nonce: nonce})
+	if err != nil {
+		return "", "", err
+	}
+
+	cipherText := aead.Seal(nil, nonce, sigJSON, []byte{})
+
+	return b64.URLEncoding.EncodeToString(cipherText), b64.URLEncoding.EncodeToString(metaJSON), nil
+}
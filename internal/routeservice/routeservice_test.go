@@ -0,0 +1,97 @@
+package routeservice_test
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	rs "github.com/OllieJC/authenticating-route-service/internal/routeservice"
+)
+
+var _ = Describe("RouteService", func() {
+	const forwardedURL = "https://app.example.local/path?q=1"
+
+	var verifier *rs.Verifier
+
+	BeforeEach(func() {
+		var err error
+		verifier, err = rs.NewVerifier([]string{"current-secret", "previous-secret"}, 30*time.Second)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should verify a signature made with the current secret", func() {
+		sig, meta, err := rs.Sign("current-secret", forwardedURL, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		signature, err := verifier.Verify(sig, meta, forwardedURL)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signature.ForwardedURL).To(Equal(forwardedURL))
+	})
+
+	It("should verify a signature made with the previous secret", func() {
+		sig, meta, err := rs.Sign("previous-secret", forwardedURL, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject a signature made with another secret", func() {
+		sig, meta, err := rs.Sign("another-secret", forwardedURL, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(errors.Is(err, rs.ErrInvalidSignature)).To(BeTrue())
+	})
+
+	It("should reject a signature for another URL", func() {
+		sig, meta, err := rs.Sign("current-secret", "https://evil.example.local/path?q=1", time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(errors.Is(err, rs.ErrInvalidSignature)).To(BeTrue())
+	})
+
+	It("should reject signatures outside of the allowed skew", func() {
+		sig, meta, err := rs.Sign("current-secret", forwardedURL, time.Now().Add(-time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(errors.Is(err, rs.ErrInvalidSignature)).To(BeTrue())
+
+		sig, meta, err = rs.Sign("current-secret", forwardedURL, time.Now().Add(time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(errors.Is(err, rs.ErrInvalidSignature)).To(BeTrue())
+
+		verifier.Now = func() time.Time { return time.Now().Add(time.Minute) }
+		sig, meta, err = rs.Sign("current-secret", forwardedURL, time.Now().Add(45*time.Second))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = verifier.Verify(sig, meta, forwardedURL)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject missing or malformed headers as malformed", func() {
+		sig, meta, err := rs.Sign("current-secret", forwardedURL, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, headers := range [][2]string{
+			{"", meta},
+			{sig, ""},
+			{"!!!", meta},
+			{sig, "!!!"},
+			{sig, b64.URLEncoding.EncodeToString([]byte("not json"))},
+			{sig, b64.URLEncoding.EncodeToString([]byte(`{"nonce": "AAAA"}`))},
+		} {
+			_, err = verifier.Verify(headers[0], headers[1], forwardedURL)
+			Expect(errors.Is(err, rs.ErrMalformedSignature)).To(BeTrue(), "%v", headers)
+		}
+	})
+
+	It("should need a secret", func() {
+		_, err := rs.NewVerifier([]string{"", ""}, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
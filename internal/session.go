@@ -1,19 +1,23 @@
 package internal
 
 import (
-	c "authenticating-route-service/internal/configurator"
-	u "authenticating-route-service/internal/utils"
-	. "authenticating-route-service/pkg/debugprint"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
 	b64 "encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	ss "github.com/OllieJC/authenticating-route-service/internal/sessionstore"
+	u "github.com/OllieJC/authenticating-route-service/internal/utils"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
 )
 
 type CustomSession struct {
@@ -33,28 +37,102 @@ func NewCustomSession() CustomSession {
 	return res
 }
 
-var _sessionSvrToken = ""
+// SessionStore records active sessions server-side so they can be revoked, when nil
+// a session is valid for as long as its cookie
+var SessionStore ss.SessionStore
+
+// RevokeSession ends the session immediately, it is a no-op without a SessionStore
+func RevokeSession(id string) error {
+	if SessionStore == nil || id == "" {
+		return nil
+	}
+	return SessionStore.Revoke(id)
+}
+
+var (
+	errNoSessionKey      error = errors.New("No session key configured")
+	errUnknownSessionKey error = errors.New("Session cookie key not recognised")
+	errBadSessionCookie  error = errors.New("Session cookie could not be decrypted")
+)
 
+// GetSessionSvrToken returns the key used to encrypt session cookies for the request's domain
 func GetSessionSvrToken(request *http.Request) string {
-	if _sessionSvrToken == "" {
-		dc, err := c.GetDomainConfigFromRequest(request)
-		if err == nil && dc.Domain != "" {
-			_sessionSvrToken = dc.SessionServerToken
-		}
+	tokens := GetSessionSvrTokens(request)
+	if len(tokens) == 0 {
+		return ""
 	}
-	return _sessionSvrToken
+	return tokens[0]
 }
 
-var _sessionCookieName = ""
+// GetSessionSvrTokens returns the request domain's session keys, the first is used to
+// encrypt. Domains which aren't in the config have no keys, so no sessions.
+func GetSessionSvrTokens(request *http.Request) []string {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil || dc.Domain == "" {
+		return nil
+	}
+	return dc.GetSessionServerTokens()
+}
 
-func GetSessionCookieName(request *http.Request) string {
-	if _sessionCookieName == "" {
-		dc, err := c.GetDomainConfigFromRequest(request)
-		if err == nil && dc.Domain != "" {
-			_sessionCookieName = fmt.Sprintf("_session%s", dc.SessionCookieName)
+// SessionKeyID returns the identifier of a session key which is sent in the cookie
+func SessionKeyID(token string) string {
+	return fmt.Sprintf("%x", createHash("session-key-id:" + token)[:4])
+}
+
+// EncryptSession encrypts the session data with the key, prefixed by the key's ID
+func EncryptSession(data string, token string) (string, error) {
+	encString, err := Encrypt(data, token)
+	if err != nil {
+		return "", err
+	}
+	return SessionKeyID(token) + "." + encString, nil
+}
+
+// DecryptSession decrypts a cookie value with the key named by its key ID, cookies from
+// before key IDs were added are tried with each key. It also returns false if the
+// cookie wasn't encrypted with the first (current) key.
+func DecryptSession(value string, tokens []string) ([]byte, bool, error) {
+	if len(tokens) == 0 {
+		return nil, false, errNoSessionKey
+	}
+
+	if n := strings.Index(value, "."); n >= 0 {
+		kid, data := value[:n], value[n+1:]
+		for idx, token := range tokens {
+			if SessionKeyID(token) == kid {
+				plaintext, err := Decrypt(data, token)
+				return plaintext, idx == 0, err
+			}
+		}
+		return nil, false, errUnknownSessionKey
+	}
+
+	for _, token := range tokens {
+		if plaintext, err := Decrypt(value, token); err == nil {
+			return plaintext, false, nil
 		}
 	}
-	return _sessionCookieName
+	return nil, false, errBadSessionCookie
+}
+
+// GetSessionCookieName returns the session cookie name for the request's domain, or ""
+// if the domain isn't in the config
+func GetSessionCookieName(request *http.Request) string {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil || dc.Domain == "" {
+		return ""
+	}
+	return fmt.Sprintf("_session%s", dc.SessionCookieName)
+}
+
+// GetSessionCookieDomain returns the Domain attribute for the request domain's session
+// cookie, "" for the hostname only
+func GetSessionCookieDomain(request *http.Request) string {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil {
+		return ""
+	}
+	return dc.SessionCookieDomain()
 }
 
 func createHash(key string) []byte {
@@ -100,6 +178,9 @@ func Decrypt(data string, passphrase string) ([]byte, error) {
 	}
 
 	nonceSize := gcm.NonceSize()
+	if len(sDec) < nonceSize {
+		return nil, errBadSessionCookie
+	}
 	nonce, ciphertext := sDec[:nonceSize], sDec[nonceSize:]
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
@@ -124,7 +205,7 @@ func CheckCookie(request *http.Request) (bool, CustomSession) {
 	}
 
 	if len(cookie.Value) > 0 {
-		decString, err := Decrypt(cookie.Value, GetSessionSvrToken(request))
+		decString, current, err := DecryptSession(cookie.Value, GetSessionSvrTokens(request))
 		if err != nil {
 			Debugfln("CheckCookie: %#v", err)
 			return false, blank_sess
@@ -137,9 +218,16 @@ func CheckCookie(request *http.Request) (bool, CustomSession) {
 			return false, blank_sess
 		}
 
-		Debugfln("CheckCookie: Session ID: %s Session Expiry: %d", sess.ID, sess.ExpiryTime)
+		Debugfln("CheckCookie: Session ID: %s Session Expiry: %d Current key: %t", sess.ID, sess.ExpiryTime, current)
 
 		if sess.ExpiryTime > time.Now().Unix() {
+			if SessionStore != nil {
+				active, err := SessionStore.Active(sess.ID)
+				if err != nil || !active {
+					Debugfln("CheckCookie: Session not active: %t %#v", active, err)
+					return false, blank_sess
+				}
+			}
 			return true, sess
 		}
 	}
@@ -156,8 +244,12 @@ func AddCookie(request *http.Request, response *http.Response, provider string,
 	sess := NewCustomSession()
 	if ok {
 		Debugfln("AddCookie: Session cookie already exists")
+		sess.ID = cookieSess.ID
 		sess.Provider = cookieSess.Provider
 		sess.UserData = cookieSess.UserData
+	} else if provider == "" {
+		Debugfln("AddCookie: No session to add")
+		return
 	} else {
 		Debugfln("AddCookie: Cookie doesn't exist")
 		sess.Provider = provider
@@ -172,24 +264,47 @@ func AddCookie(request *http.Request, response *http.Response, provider string,
 		return
 	}
 
-	encString, err := Encrypt(string(b), GetSessionSvrToken(request))
+	tokens := GetSessionSvrTokens(request)
+	if len(tokens) == 0 {
+		Debugfln("AddCookie: No session key for domain")
+		return
+	}
+
+	encString, err := EncryptSession(string(b), tokens[0])
 	if err != nil {
 		Debugfln("AddCookie: err: %#v", err)
 		return
 	}
 
-	expiryTime := expiryTime()
+	expiryTime := time.Unix(sess.ExpiryTime, 0)
+
+	if SessionStore != nil && ok {
+		// the session may have been revoked since it was checked, so it's only extended
+		renewed, err := SessionStore.Renew(sess.ID, expiryTime)
+		if err != nil || !renewed {
+			Debugfln("AddCookie: Session not renewed: %t %#v", renewed, err)
+			return
+		}
+	} else if SessionStore != nil {
+		if err = SessionStore.Save(sess.ID, expiryTime); err != nil {
+			Debugfln("AddCookie: err: %#v", err)
+			return
+		}
+	}
+
+	cookieName := GetSessionCookieName(request)
 	cookie := &http.Cookie{
-		Name:     GetSessionCookieName(request),
+		Name:     cookieName,
 		Value:    encString,
 		Expires:  expiryTime,
 		Path:     "/",
+		Domain:   GetSessionCookieDomain(request),
 		HttpOnly: true,
 		Secure:   true,
 	}
 	response.Header.Add("Set-Cookie", cookie.String())
 
-	Debugfln("AddCookie: Setting '%s'", GetSessionCookieName(request))
+	Debugfln("AddCookie: Setting '%s'", cookieName)
 
 }
 
@@ -14,10 +14,24 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	s "authenticating-route-service/internal"
-	h "authenticating-route-service/internal/httphelper"
+	s "github.com/OllieJC/authenticating-route-service/internal"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	ss "github.com/OllieJC/authenticating-route-service/internal/sessionstore"
 )
 
+// revokedAfterCheckStore revokes each session straight after it's checked, like a logout
+// racing with another request for the same session
+type revokedAfterCheckStore struct {
+	*ss.MemoryStore
+}
+
+func (r revokedAfterCheckStore) Active(id string) (bool, error) {
+	active, err := r.MemoryStore.Active(id)
+	r.MemoryStore.Revoke(id)
+	return active, err
+}
+
 func parseCookieTime(rawCookieStr string) (time.Time, error) {
 	if rawCookieStr != "" && strings.Contains(rawCookieStr, ";") {
 		splitCookie := strings.Split(rawCookieStr, ";")
@@ -46,6 +60,23 @@ var _ = Describe("Sessions", func() {
 		Expect(string(decString)).To(Equal(testString))
 	})
 
+	It("should scope the session cookie to a shared wildcard domain", func() {
+		request := httptest.NewRequest("GET", "http://pr-1.preview.example.local/auth/google/callback", nil)
+		response := h.EmptyHTTPResponse(request)
+
+		s.AddCookie(request, response, "Test", "abc123")
+
+		cookieRawVal := response.Header.Get("Set-Cookie")
+		Expect(cookieRawVal).To(HavePrefix("_sessionPREVIEW="))
+		Expect(cookieRawVal).To(ContainSubstring("; Domain=preview.example.local;"))
+
+		request = httptest.NewRequest("GET", "http://example.local/auth/google/callback", nil)
+		response = h.EmptyHTTPResponse(request)
+
+		s.AddCookie(request, response, "Test", "abc123")
+		Expect(response.Header.Get("Set-Cookie")).NotTo(ContainSubstring("Domain="))
+	})
+
 	It("should add a cookie with AddCookie", func() {
 
 		request := httptest.NewRequest("GET", "http://example.local/auth/google/callback", nil)
@@ -104,11 +135,13 @@ var _ = Describe("Sessions", func() {
 		b, err := json.Marshal(sess)
 		Expect(err).NotTo(HaveOccurred())
 
-		encString, err := s.Encrypt(string(b), "")
+		request := httptest.NewRequest("GET", "http://example.local/", nil)
+
+		encString, err := s.Encrypt(string(b), s.GetSessionSvrToken(request))
 		Expect(err).NotTo(HaveOccurred())
 
-		cookie := http.Cookie{Name: "_session", Value: encString}
-		request := &http.Request{Header: http.Header{"Cookie": []string{cookie.String()}}}
+		cookie := http.Cookie{Name: s.GetSessionCookieName(request), Value: encString}
+		request.AddCookie(&cookie)
 
 		response := h.EmptyHTTPResponse(nil)
 		s.AddCookie(request, response, "", "")
@@ -117,4 +150,212 @@ var _ = Describe("Sessions", func() {
 		Expect(cookieInResponse).ShouldNot(Equal(""))
 		Expect(cookieInResponse).ShouldNot(Equal(cookie.String()))
 	})
+
+	It("should not add a cookie without a session or provider", func() {
+		request := httptest.NewRequest("GET", "http://example.local/test/unauth", nil)
+		response := h.EmptyHTTPResponse(request)
+
+		s.AddCookie(request, response, "", "")
+
+		Expect(response.Header.Get("Set-Cookie")).To(BeEmpty())
+	})
+
+	It("should not accept or set cookies for a domain without a session token", func() {
+		c.Register(c.DomainConfig{Domain: "notoken.example.local", Enabled: true})
+		defer c.Unregister("notoken.example.local")
+
+		request := httptest.NewRequest("GET", "http://notoken.example.local/", nil)
+		Expect(s.GetSessionSvrTokens(request)).To(BeEmpty())
+
+		sess := s.NewCustomSession()
+		sess.Provider = "Test"
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+		for _, encrypt := range []func(string, string) (string, error){s.Encrypt, s.EncryptSession} {
+			encString, err := encrypt(string(b), "")
+			Expect(err).NotTo(HaveOccurred())
+
+			forged := httptest.NewRequest("GET", "http://notoken.example.local/", nil)
+			forged.AddCookie(&http.Cookie{Name: s.GetSessionCookieName(forged), Value: encString})
+			ok, _ := s.CheckCookie(forged)
+			Expect(ok).To(BeFalse())
+		}
+
+		response := h.EmptyHTTPResponse(request)
+		s.AddCookie(request, response, "Test", "abc123")
+		Expect(response.Header.Get("Set-Cookie")).To(BeEmpty())
+	})
+
+	Context("with a SessionStore", func() {
+		BeforeEach(func() {
+			s.SessionStore = ss.NewMemoryStore()
+		})
+
+		AfterEach(func() {
+			s.SessionStore = nil
+		})
+
+		login := func() (*http.Request, s.CustomSession) {
+			loginRequest := httptest.NewRequest("GET", "http://example.local/auth/callback/github/third.example.local", nil)
+			response := h.EmptyHTTPResponse(loginRequest)
+			s.AddCookie(loginRequest, response, "Test", "abc123")
+
+			request := httptest.NewRequest("GET", "http://example.local/", nil)
+			request.Header.Set("Cookie", response.Header.Get("Set-Cookie"))
+
+			ok, sess := s.CheckCookie(request)
+			Expect(ok).To(BeTrue())
+			return request, sess
+		}
+
+		It("should not accept a valid cookie for a session which was never saved", func() {
+			sess := s.NewCustomSession()
+			sess.Provider = "Test"
+			b, err := json.Marshal(sess)
+			Expect(err).NotTo(HaveOccurred())
+
+			request := httptest.NewRequest("GET", "http://example.local/", nil)
+			encString, err := s.Encrypt(string(b), s.GetSessionSvrToken(request))
+			Expect(err).NotTo(HaveOccurred())
+			request.AddCookie(&http.Cookie{Name: s.GetSessionCookieName(request), Value: encString})
+
+			ok, _ := s.CheckCookie(request)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should keep the session ID when renewing the cookie", func() {
+			request, sess := login()
+
+			response := h.EmptyHTTPResponse(request)
+			s.AddCookie(request, response, "", "")
+
+			renewed := httptest.NewRequest("GET", "http://example.local/", nil)
+			renewed.Header.Set("Cookie", response.Header.Get("Set-Cookie"))
+
+			ok, renewedSess := s.CheckCookie(renewed)
+			Expect(ok).To(BeTrue())
+			Expect(renewedSess.ID).To(Equal(sess.ID))
+		})
+
+		It("should not accept the cookie of a revoked session", func() {
+			request, sess := login()
+
+			Expect(s.RevokeSession(sess.ID)).To(Succeed())
+
+			ok, _ := s.CheckCookie(request)
+			Expect(ok).To(BeFalse())
+
+			response := h.EmptyHTTPResponse(request)
+			s.AddCookie(request, response, "", "")
+			Expect(response.Header.Get("Set-Cookie")).To(BeEmpty())
+		})
+
+		It("should not renew a session which is revoked after it was checked", func() {
+			request, sess := login()
+
+			store := s.SessionStore.(*ss.MemoryStore)
+			s.SessionStore = revokedAfterCheckStore{store}
+
+			response := h.EmptyHTTPResponse(request)
+			s.AddCookie(request, response, "", "")
+			Expect(response.Header.Get("Set-Cookie")).To(BeEmpty())
+
+			active, err := store.Active(sess.ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		})
+
+		It("should revoke the session on logout", func() {
+			request, _ := login()
+
+			logout := httptest.NewRequest("GET", "http://example.local/auth/logout", nil)
+			logout.Header.Set("Cookie", request.Header.Get("Cookie"))
+			_, err := s.AuthRequestDecision(logout)
+			Expect(err).NotTo(HaveOccurred())
+
+			ok, _ := s.CheckCookie(request)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("with multiple session keys", func() {
+		sessionCookie := func(request *http.Request, value string) *http.Request {
+			r := httptest.NewRequest("GET", "http://example.local/", nil)
+			r.AddCookie(&http.Cookie{Name: s.GetSessionCookieName(request), Value: value})
+			return r
+		}
+
+		testSession := func() string {
+			sess := s.NewCustomSession()
+			sess.Provider = "Test"
+			sess.UserData = "abc123"
+			b, err := json.Marshal(sess)
+			Expect(err).NotTo(HaveOccurred())
+			return string(b)
+		}
+
+		It("should encrypt new cookies with the first key and its key ID", func() {
+			request := httptest.NewRequest("GET", "http://example.local/auth/callback/google/email.example.local", nil)
+			response := h.EmptyHTTPResponse(request)
+
+			s.AddCookie(request, response, "Test", "abc123")
+
+			cookies := (&http.Response{Header: response.Header}).Cookies()
+			Expect(cookies).To(HaveLen(1))
+			Expect(cookies[0].Value).To(HavePrefix(s.SessionKeyID("GHI123-0123456789abcdef0123456789abcdef") + "."))
+		})
+
+		It("should accept and re-issue cookies encrypted with an older key", func() {
+			request := httptest.NewRequest("GET", "http://example.local/", nil)
+
+			encString, err := s.EncryptSession(testSession(), "DEF890-0123456789abcdef0123456789abcdef")
+			Expect(err).NotTo(HaveOccurred())
+			request = sessionCookie(request, encString)
+
+			ok, _ := s.CheckCookie(request)
+			Expect(ok).To(BeTrue())
+
+			response := h.EmptyHTTPResponse(request)
+			s.AddCookie(request, response, "", "")
+
+			cookies := (&http.Response{Header: response.Header}).Cookies()
+			Expect(cookies).To(HaveLen(1))
+			Expect(cookies[0].Value).To(HavePrefix(s.SessionKeyID("GHI123-0123456789abcdef0123456789abcdef") + "."))
+		})
+
+		It("should accept cookies from before key IDs were added", func() {
+			request := httptest.NewRequest("GET", "http://example.local/", nil)
+
+			encString, err := s.Encrypt(testSession(), "DEF890-0123456789abcdef0123456789abcdef")
+			Expect(err).NotTo(HaveOccurred())
+
+			ok, _ := s.CheckCookie(sessionCookie(request, encString))
+			Expect(ok).To(BeTrue())
+		})
+
+		It("should not accept cookies encrypted with a removed key", func() {
+			request := httptest.NewRequest("GET", "http://example.local/", nil)
+
+			encString, err := s.EncryptSession(testSession(), "REMOVED")
+			Expect(err).NotTo(HaveOccurred())
+			ok, _ := s.CheckCookie(sessionCookie(request, encString))
+			Expect(ok).To(BeFalse())
+
+			encString, err = s.Encrypt(testSession(), "REMOVED")
+			Expect(err).NotTo(HaveOccurred())
+			ok, _ = s.CheckCookie(sessionCookie(request, encString))
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should not accept a key ID with another key's ciphertext", func() {
+			encString, err := s.Encrypt(testSession(), "DEF890-0123456789abcdef0123456789abcdef")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = s.DecryptSession(s.SessionKeyID("GHI123-0123456789abcdef0123456789abcdef")+"."+encString, []string{"GHI123-0123456789abcdef0123456789abcdef", "DEF890-0123456789abcdef0123456789abcdef"})
+			Expect(err).To(HaveOccurred())
+
+			_, _, err = s.DecryptSession(s.SessionKeyID("GHI123-0123456789abcdef0123456789abcdef")+".AAAA", []string{"GHI123-0123456789abcdef0123456789abcdef", "DEF890-0123456789abcdef0123456789abcdef"})
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
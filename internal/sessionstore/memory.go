@@ -0,0 +1,77 @@
+package sessionstore
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore is a SessionStore held in the memory of a single instance
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+// Save records the session as active until the expiry time
+func (s *MemoryStore) Save(id string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, exp := range s.sessions {
+			if !exp.After(now) {
+				delete(s.sessions, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.sessions[id] = expiry
+	return nil
+}
+
+// Renew extends an active session until the expiry time, it returns false without
+// saving the session if it has been revoked or has expired
+func (s *MemoryStore) Renew(id string, expiry time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.sessions[id]
+	if !ok || !exp.After(time.Now()) {
+		return false, nil
+	}
+
+	s.sessions[id] = expiry
+	return true, nil
+}
+
+// Active returns true if the session was saved, has not expired and has not been revoked
+func (s *MemoryStore) Active(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exp, ok := s.sessions[id]
+	if !ok {
+		return false, nil
+	}
+	if !exp.After(time.Now()) {
+		delete(s.sessions, id)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Revoke removes the session so it is no longer active
+func (s *MemoryStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
@@ -0,0 +1,100 @@
+package sessionstore
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const redisKeyPrefix = "ars:session:"
+
+// RedisStore is a SessionStore shared between instances through Redis
+type RedisStore struct {
+	pool *redis.Pool
+}
+
+// NewRedisStore returns a RedisStore connecting to a redis:// or rediss:// URL
+func NewRedisStore(url string) (*RedisStore, error) {
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(url,
+				redis.DialConnectTimeout(5*time.Second),
+				redis.DialReadTimeout(5*time.Second),
+				redis.DialWriteTimeout(5*time.Second),
+			)
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &RedisStore{pool: pool}, nil
+}
+
+// Save records the session as active until the expiry time
+func (s *RedisStore) Save(id string, expiry time.Time) error {
+	ttl := int64(time.Until(expiry) / time.Millisecond)
+	if ttl <= 0 {
+		return s.Revoke(id)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", redisKeyPrefix+id, expiry.Unix(), "PX", ttl)
+	return err
+}
+
+// Renew extends an active session until the expiry time, it returns false without
+// saving the session if it has been revoked or has expired
+func (s *RedisStore) Renew(id string, expiry time.Time) (bool, error) {
+	ttl := int64(time.Until(expiry) / time.Millisecond)
+	if ttl <= 0 {
+		return false, s.Revoke(id)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	// XX only sets the key if it exists, so a revoked session isn't saved again
+	reply, err := conn.Do("SET", redisKeyPrefix+id, expiry.Unix(), "PX", ttl, "XX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Active returns true if the session was saved, has not expired and has not been revoked
+func (s *RedisStore) Active(id string) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", redisKeyPrefix+id))
+}
+
+// Revoke removes the session so it is no longer active
+func (s *RedisStore) Revoke(id string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", redisKeyPrefix+id)
+	return err
+}
+
+// Close closes the connections to Redis
+func (s *RedisStore) Close() error {
+	return s.pool.Close()
+}
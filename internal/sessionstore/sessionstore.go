@@ -0,0 +1,38 @@
+package sessionstore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SessionStore keeps a server-side record of active sessions, keyed by session ID,
+// so that a session can be revoked before its cookie expires
+type SessionStore interface {
+	// Save records the session as active until the expiry time
+	Save(id string, expiry time.Time) error
+
+	// Renew extends an active session until the expiry time, it returns false without
+	// saving the session if it has been revoked or has expired
+	Renew(id string, expiry time.Time) (bool, error)
+
+	// Active returns true if the session was saved, has not expired and has not been revoked
+	Active(id string) (bool, error)
+
+	// Revoke removes the session so it is no longer active
+	Revoke(id string) error
+}
+
+// New returns the store of the kind ("memory" or "redis"), url is only used by the Redis
+// store. An empty kind returns a nil store, which disables server-side sessions.
+func New(kind string, url string) (SessionStore, error) {
+	switch strings.ToLower(kind) {
+	case "":
+		return nil, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "redis":
+		return NewRedisStore(url)
+	}
+	return nil, fmt.Errorf("unknown session store: %s", kind)
+}
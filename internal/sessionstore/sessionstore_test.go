@@ -0,0 +1,143 @@
+package sessionstore_test
+
+import (
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	ss "github.com/OllieJC/authenticating-route-service/internal/sessionstore"
+)
+
+func behavesLikeASessionStore(newStore func() ss.SessionStore) {
+	var store ss.SessionStore
+
+	BeforeEach(func() {
+		store = newStore()
+	})
+
+	It("should not know about unsaved sessions", func() {
+		active, err := store.Active("unknown")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeFalse())
+	})
+
+	It("should return saved sessions as active", func() {
+		Expect(store.Save("session-1", time.Now().Add(time.Hour))).To(Succeed())
+
+		active, err := store.Active("session-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeTrue())
+	})
+
+	It("should not return revoked sessions as active", func() {
+		Expect(store.Save("session-1", time.Now().Add(time.Hour))).To(Succeed())
+		Expect(store.Save("session-2", time.Now().Add(time.Hour))).To(Succeed())
+		Expect(store.Revoke("session-1")).To(Succeed())
+
+		active, err := store.Active("session-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeFalse())
+
+		active, err = store.Active("session-2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeTrue())
+	})
+
+	It("should renew active sessions", func() {
+		Expect(store.Save("session-1", time.Now().Add(time.Minute))).To(Succeed())
+
+		renewed, err := store.Renew("session-1", time.Now().Add(time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(renewed).To(BeTrue())
+
+		active, err := store.Active("session-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeTrue())
+	})
+
+	It("should not save revoked or unknown sessions when renewing them", func() {
+		Expect(store.Save("session-1", time.Now().Add(time.Hour))).To(Succeed())
+		Expect(store.Revoke("session-1")).To(Succeed())
+
+		for _, id := range []string{"session-1", "unknown"} {
+			renewed, err := store.Renew(id, time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(renewed).To(BeFalse())
+
+			active, err := store.Active(id)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		}
+	})
+
+	It("should not return expired sessions as active", func() {
+		Expect(store.Save("session-1", time.Now().Add(-time.Second))).To(Succeed())
+
+		active, err := store.Active("session-1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(BeFalse())
+	})
+}
+
+var _ = Describe("SessionStore", func() {
+	Context("MemoryStore", func() {
+		behavesLikeASessionStore(func() ss.SessionStore {
+			return ss.NewMemoryStore()
+		})
+	})
+
+	Context("RedisStore", func() {
+		var server *miniredis.Miniredis
+
+		BeforeEach(func() {
+			var err error
+			server, err = miniredis.Run()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		behavesLikeASessionStore(func() ss.SessionStore {
+			store, err := ss.NewRedisStore("redis://" + server.Addr())
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		})
+
+		It("should expire sessions in Redis at the expiry time", func() {
+			store, err := ss.NewRedisStore("redis://" + server.Addr())
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(store.Save("session-1", time.Now().Add(time.Minute))).To(Succeed())
+			server.FastForward(2 * time.Minute)
+
+			active, err := store.Active("session-1")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(active).To(BeFalse())
+		})
+
+		It("should return an error when Redis can't be reached", func() {
+			addr := server.Addr()
+			server.Close()
+
+			_, err := ss.NewRedisStore("redis://" + addr)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should create stores by kind", func() {
+		store, err := ss.New("", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store).To(BeNil())
+
+		store, err = ss.New("memory", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store).To(BeAssignableToTypeOf(&ss.MemoryStore{}))
+
+		_, err = ss.New("cassandra", "")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+)
+
+// LoginURLHeader is set on 401 verify responses, for ingress controllers to redirect to
+const LoginURLHeader = "X-Auth-Login-URL"
+
+var (
+	errNoVerifyTarget  = errors.New("Set X-Original-URL, or X-Forwarded-Host and X-Forwarded-Uri, to the URL being verified")
+	errUnauthenticated = errors.New("Log in to continue")
+)
+
+// verifyTarget returns a copy of the forward auth request for the URL being verified, taken
+// from X-Original-URL (nginx) or X-Forwarded-Proto, -Host, -Uri and -Method (Traefik)
+func verifyTarget(request *http.Request) (*http.Request, error) {
+	var target *url.URL
+
+	if original := request.Header.Get("X-Original-URL"); original != "" {
+		u, err := url.Parse(original)
+		if err != nil || u.Host == "" {
+			return nil, errNoVerifyTarget
+		}
+		target = u
+	} else {
+		host := request.Header.Get("X-Forwarded-Host")
+		if host == "" {
+			return nil, errNoVerifyTarget
+		}
+
+		scheme := strings.ToLower(request.Header.Get("X-Forwarded-Proto"))
+		if scheme != "http" {
+			scheme = "https"
+		}
+
+		uri := request.Header.Get("X-Forwarded-Uri")
+		if !strings.HasPrefix(uri, "/") {
+			uri = "/" + uri
+		}
+
+		u, err := url.Parse(scheme + "://" + host + uri)
+		if err != nil || u.Host != host {
+			return nil, errNoVerifyTarget
+		}
+		target = u
+	}
+
+	method := request.Header.Get("X-Forwarded-Method")
+	if method == "" {
+		method = request.Method
+	}
+
+	res := request.WithContext(request.Context())
+	res.Method = method
+	res.URL = target
+	res.Host = target.Host
+	res.Header = request.Header.Clone()
+	return res, nil
+}
+
+// VerifyResponse answers forward auth requests from ingress controllers (nginx auth_request,
+// Traefik ForwardAuth): 200 with the identity headers, 401 with the login URL or 403
+func VerifyResponse(request *http.Request) *http.Response {
+	target, err := verifyTarget(request)
+	if err != nil {
+		Debugfln("VerifyResponse:err: %s", err.Error())
+		return h.HTTPStatusResponse(http.StatusBadRequest, "Bad Request", err)
+	}
+
+	return Verify(target)
+}
+
+// Verify returns the auth decision for a request with an absolute URL, as VerifyResponse
+func Verify(target *http.Request) *http.Response {
+	Debugfln("Verify:1: %s %s", target.Method, target.URL.String())
+
+	dc, err := c.GetDomainConfigFromRequest(target)
+	if err != nil {
+		return h.HTTPForbiddenResponse()
+	}
+
+	if c.IsUnauthPath(target) {
+		Debugfln("Verify:2: Unauth path")
+		response := h.EmptyHTTPResponse(target)
+		response.Status = "OK"
+		response.StatusCode = http.StatusOK
+		return response
+	}
+
+	authenticated, sess := CheckCookie(target)
+	if !authenticated {
+		Debugfln("Verify:2: Unauthenticated")
+
+		loginURL := url.URL{Scheme: target.URL.Scheme, Host: target.URL.Host, Path: "/auth/login"}
+
+		response := h.HTTPStatusResponse(http.StatusUnauthorized, "Unauthorised", errUnauthenticated)
+		response.Header.Set(LoginURLHeader, loginURL.String())
+		cookie := &http.Cookie{
+			Name:     redirectCookieName,
+			Value:    target.URL.RequestURI(),
+			Expires:  time.Now().Add(2 * time.Hour),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		}
+		response.Header.Add("Set-Cookie", cookie.String())
+		return response
+	}
+
+	if !IsAuthorised(target, sess) {
+		Debugfln("Verify:2: Forbidden")
+		return h.HTTPForbiddenResponse()
+	}
+
+	Debugfln("Verify:2: OK")
+	response := h.EmptyHTTPResponse(target)
+	response.Status = "OK"
+	response.StatusCode = http.StatusOK
+	addIdentityHeaders(response.Header, dc, sess)
+	return response
+}
@@ -0,0 +1,96 @@
+package internal_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	s "github.com/OllieJC/authenticating-route-service/internal"
+)
+
+var _ = Describe("Verify", func() {
+	sessionCookie := func(email string) *http.Cookie {
+		sess := s.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "` + email + `", "organisations": []}`
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+
+		domainRequest := httptest.NewRequest("GET", "https://example.local/", nil)
+		encString, err := s.EncryptSession(string(b), s.GetSessionSvrToken(domainRequest))
+		Expect(err).NotTo(HaveOccurred())
+
+		return &http.Cookie{Name: s.GetSessionCookieName(domainRequest), Value: encString}
+	}
+
+	traefikRequest := func(uri string, cookie *http.Cookie) *http.Request {
+		request := httptest.NewRequest("GET", "http://auth.internal/auth/verify", nil)
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Host", "example.local")
+		request.Header.Set("X-Forwarded-Uri", uri)
+		if cookie != nil {
+			request.AddCookie(cookie)
+		}
+		return request
+	}
+
+	It("should return 400 without the URL being verified", func() {
+		request := httptest.NewRequest("GET", "http://auth.internal/auth/verify", nil)
+
+		Expect(s.VerifyResponse(request).StatusCode).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should return 401 with the login URL without a session", func() {
+		response := s.VerifyResponse(traefikRequest("/private?q=1", nil))
+
+		Expect(response.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(response.Header.Get(s.LoginURLHeader)).To(Equal("https://example.local/auth/login"))
+		Expect(response.Header.Get("Set-Cookie")).To(HavePrefix("_redirectPath=/private?q=1;"))
+	})
+
+	It("should return 200 for unauthenticated paths", func() {
+		response := s.VerifyResponse(traefikRequest("/test/unauth", nil))
+
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("X-Auth-Email")).To(BeEmpty())
+	})
+
+	It("should return 401 for paths which only look like unauthenticated paths", func() {
+		for _, uri := range []string{"/test/unauth/../admin", "/test/unauth/%2e%2e/admin", "/test/unauthorised"} {
+			Expect(s.VerifyResponse(traefikRequest(uri, nil)).StatusCode).To(Equal(http.StatusUnauthorized), uri)
+		}
+	})
+
+	It("should return 200 with the identity headers for a valid session", func() {
+		response := s.VerifyResponse(traefikRequest("/private", sessionCookie("someone@email.example.local")))
+
+		Expect(response.StatusCode).To(Equal(http.StatusOK))
+		Expect(response.Header.Get("X-Auth-Email")).To(Equal("someone@email.example.local"))
+		Expect(response.Header.Get("X-Auth-User")).To(Equal("octocat"))
+		Expect(response.Header.Get("X-Auth-Provider")).To(BeEmpty())
+	})
+
+	It("should return 403 when the access rules don't allow the user", func() {
+		response := s.VerifyResponse(traefikRequest("/admin", sessionCookie("someone@email.example.local")))
+
+		Expect(response.StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("should read the URL from X-Original-URL", func() {
+		request := httptest.NewRequest("GET", "http://auth.internal/auth/verify", nil)
+		request.Header.Set("X-Original-URL", "https://example.local/admin")
+		request.AddCookie(sessionCookie("admin@email.example.local"))
+
+		Expect(s.VerifyResponse(request).StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should return 403 for unknown domains", func() {
+		request := httptest.NewRequest("GET", "http://auth.internal/auth/verify", nil)
+		request.Header.Set("X-Original-URL", "https://unknown.local/")
+
+		Expect(s.VerifyResponse(request).StatusCode).To(Equal(http.StatusForbidden))
+	})
+})
@@ -1,30 +1,39 @@
 package main
 
 import (
-	i "authenticating-route-service/internal"
-	c "authenticating-route-service/internal/configurator"
-	h "authenticating-route-service/internal/httphelper"
-	d "authenticating-route-service/pkg/debugprint"
-	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	a "github.com/OllieJC/authenticating-route-service/internal/audit"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	ea "github.com/OllieJC/authenticating-route-service/internal/extauthz"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	rs "github.com/OllieJC/authenticating-route-service/internal/routeservice"
+	ss "github.com/OllieJC/authenticating-route-service/internal/sessionstore"
+	d "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
 )
 
 const (
-	defaultPort            = 8080
-	cfForwardedURLHeader   = "X-Cf-Forwarded-Url"
-	cfProxySignatureHeader = "X-Cf-Proxy-Signature"
-	cfProxyMetadataHeader  = "X-CF-Proxy-Metadata"
-	redirectCookieName     = "_redirectPath"
+	defaultPort                 = 8080
+	defaultConfigReloadInterval = 10 * time.Second
+	cfForwardedURLHeader        = "X-Cf-Forwarded-Url"
+	cfProxySignatureHeader      = "X-Cf-Proxy-Signature"
+	cfProxyMetadataHeader       = "X-CF-Proxy-Metadata"
+	redirectCookieName          = "_redirectPath"
 )
 
 func main() {
@@ -33,6 +42,10 @@ func main() {
 		port              int64
 	)
 
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(ValidateConfigCommand(os.Args[2:], os.Stdout))
+	}
+
 	port, _ = strconv.ParseInt(os.Getenv("PORT"), 10, 16)
 	if port == 0 {
 		port = defaultPort
@@ -47,46 +60,227 @@ func main() {
 
 	log.SetOutput(os.Stdout)
 
+	if _, err := c.LoadConfig(c.FilePath()); err != nil {
+		log.Println("main:err: Config:", err.Error())
+	}
+	watchConfig()
+
+	store, err := ss.New(os.Getenv("SESSION_STORE"), os.Getenv("SESSION_STORE_URL"))
+	if err != nil {
+		log.Fatalln("main:err:", err.Error())
+	}
+	i.SessionStore = store
+
 	roundTripper := NewAuthRoundTripper(skipSslValidation)
-	proxy := NewProxy(roundTripper)
+
+	if secret := os.Getenv("ROUTE_SERVICE_SECRET"); secret != "" {
+		maxSkew, _ := time.ParseDuration(os.Getenv("ROUTE_SERVICE_SIGNATURE_MAX_SKEW"))
+
+		roundTripper.SignatureVerifier, err = rs.NewVerifier([]string{secret, os.Getenv("ROUTE_SERVICE_SECRET_PREVIOUS")}, maxSkew)
+		if err != nil {
+			log.Fatalln("main:err:", err.Error())
+		}
+	}
+
+	// forward auth trusts the ingress's X-Original-URL and X-Forwarded-* headers, which
+	// gorouter doesn't sign, so it's only served when there is an ingress to set them
+	forwardAuth, _ := strconv.ParseBool(os.Getenv("FORWARD_AUTH"))
+
+	var proxy http.Handler
+	switch mode := os.Getenv("PROXY_MODE"); mode {
+	case "", "cloudfoundry":
+		proxy = NewProxy(roundTripper)
+	case "standalone":
+		// there's no gorouter to sign requests, so every request would be rejected
+		if roundTripper.SignatureVerifier != nil {
+			log.Fatalln("main:err: ROUTE_SERVICE_SECRET can't be used with PROXY_MODE=standalone")
+		}
+		proxy = NewStandaloneProxy(roundTripper)
+		forwardAuth = true
+	default:
+		log.Fatalln("main:err: Unknown PROXY_MODE:", mode)
+	}
+	if forwardAuth {
+		proxy = NewForwardAuthHandler(proxy)
+	}
+
+	if extAuthzPort := os.Getenv("EXT_AUTHZ_PORT"); extAuthzPort != "" {
+		lis, err := net.Listen("tcp", ":"+extAuthzPort)
+		if err != nil {
+			log.Fatalln("main:err:", err.Error())
+		}
+		go func() {
+			log.Fatal(ea.NewGRPCServer().Serve(lis))
+		}()
+	}
 
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), proxy))
 }
 
+// ValidateConfigCommand prints every problem in the config file given, or
+// DOMAIN_CONFIG_FILEPATH, and returns the exit code
+func ValidateConfigCommand(args []string, out io.Writer) int {
+	filename := c.FilePath()
+	if len(args) > 0 {
+		filename = args[0]
+	}
+	_, err := c.ReadConfigFile(filename)
+	if err == nil {
+		fmt.Fprintf(out, "%s: OK\n", filename)
+		return 0
+	}
+
+	verr, ok := err.(*c.ValidationError)
+	if !ok {
+		fmt.Fprintf(out, "%s: %s\n", filename, err.Error())
+		return 1
+	}
+
+	for _, p := range verr.Problems {
+		if p.Line > 0 {
+			fmt.Fprintf(out, "%s:%d: %s: %s\n", filename, p.Line, p.Path, p.Message)
+		} else {
+			fmt.Fprintf(out, "%s: %s: %s\n", filename, p.Path, p.Message)
+		}
+	}
+	return 1
+}
+
+// watchConfig reloads the config file when it changes, or on SIGHUP
+func watchConfig() {
+	interval, err := time.ParseDuration(os.Getenv("CONFIG_RELOAD_INTERVAL"))
+	if err != nil || interval <= 0 {
+		interval = defaultConfigReloadInterval
+	}
+	go c.Watch(interval, nil)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c.Reload(false)
+		}
+	}()
+}
+
 // NewProxy sets up a http Handler using the custom AuthRoundTripper
 func NewProxy(transport http.RoundTripper) http.Handler {
 	reverseProxy := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
-			forwardedURL := req.Header.Get(cfForwardedURLHeader)
-			d.Debugfln("NewProxy:1: %s", forwardedURL)
-
-			var body []byte
-			var err error
-			if req.Body != nil {
-				body, err = ioutil.ReadAll(req.Body)
-				if err != nil {
-					log.Fatalln("NewProxy:err:", err.Error())
-				}
-				req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			}
+			d.Debugfln("NewProxy:1: %s", req.Header.Get(cfForwardedURLHeader))
 
-			// Note that url.Parse is decoding any url-encoded characters.
-			url, err := url.Parse(forwardedURL)
+			// bad forwarded URLs are left for the AuthRoundTripper to reject
+			url, err := forwardedURL(req)
 			if err != nil {
-				log.Fatalln("NewProxy:err:", err.Error())
+				d.Debugfln("NewProxy:err: %s", err.Error())
+				return
 			}
 
 			req.URL = url
 			req.Host = url.Host
 		},
 		Transport: transport,
+
+		// responses are streamed, flushing regularly so slow responses aren't held back
+		FlushInterval: 100 * time.Millisecond,
 	}
 	return reverseProxy
 }
 
+var errNoStandaloneUpstream = errors.New("No upstream_url is configured for this domain")
+
+// NewStandaloneProxy sets up a http Handler for running outside of Cloud Foundry, requests
+// are matched to a domain by their Host and forwarded to the domain's upstream_url
+func NewStandaloneProxy(transport http.RoundTripper) http.Handler {
+	proxy := NewProxy(transport)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// there's no gorouter, so the forwarded URL can't be set by the client
+		r.Header.Del(cfForwardedURLHeader)
+
+		// domains without an upstream_url can still use the /auth pages, for forward auth
+		host := (&url.URL{Host: r.Host}).Hostname()
+		dc, err := c.GetDomainConfig(host, c.FilePath())
+		if err != nil || (dc.StaticUpstreamURL == "" && !i.IsAuthPath(r.URL.EscapedPath())) {
+			d.Debugfln("NewStandaloneProxy:err: No upstream for %s", host)
+			response := h.HTTPNotFoundResponse(errNoStandaloneUpstream)
+			h.AddSecurityHeaders(r, response)
+			h.WriteResponse(w, response)
+			return
+		}
+
+		r.Header.Set(cfForwardedURLHeader, standaloneURL(r).String())
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// NewForwardAuthHandler answers /auth/verify requests from ingress controllers and passes
+// everything else to the next handler. Requests from gorouter always have a forwarded URL,
+// so they're left for the AuthRoundTripper.
+func NewForwardAuthHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/verify" || r.Header.Get(cfForwardedURLHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		d.Debugfln("NewForwardAuthHandler:1: Verify request")
+		response := i.VerifyResponse(r)
+		h.AddSecurityHeaders(r, response)
+		h.WriteResponse(w, response)
+	})
+}
+
+// standaloneURL returns the URL the client requested, as gorouter would have forwarded it
+func standaloneURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil || strings.ToLower(r.Header.Get("X-Forwarded-Proto")) == "https" {
+		scheme = "https"
+	}
+
+	return &url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+}
+
 // AuthRoundTripper object, exported for use in tests
 type AuthRoundTripper struct {
 	transport http.RoundTripper
+
+	// SignatureVerifier checks the gorouter's X-CF-Proxy-Signature, nil disables the check
+	SignatureVerifier *rs.Verifier
+}
+
+// verifySignature returns nil if signatures aren't checked or the request's is valid,
+// otherwise the response to return instead of the request
+func (lrt *AuthRoundTripper) verifySignature(request *http.Request) *http.Response {
+	if lrt.SignatureVerifier == nil {
+		return nil
+	}
+
+	_, err := lrt.SignatureVerifier.Verify(
+		request.Header.Get(cfProxySignatureHeader),
+		request.Header.Get(cfProxyMetadataHeader),
+		request.Header.Get(cfForwardedURLHeader),
+	)
+	if err == nil {
+		return nil
+	}
+
+	d.Debugfln("verifySignature:err: %s", err.Error())
+	a.Event("route_service_signature_invalid", request, map[string]string{
+		"error":         err.Error(),
+		"forwarded_url": request.Header.Get(cfForwardedURLHeader),
+	})
+
+	if errors.Is(err, rs.ErrMalformedSignature) {
+		return h.HTTPStatusResponse(http.StatusBadRequest, "Bad Request", rs.ErrMalformedSignature)
+	}
+	return h.HTTPStatusResponse(http.StatusForbidden, "Forbidden", rs.ErrInvalidSignature)
 }
 
 // NewAuthRoundTripper returns an AuthRoundTripper
@@ -99,13 +293,103 @@ func NewAuthRoundTripper(skipSslValidation bool) *AuthRoundTripper {
 	}
 }
 
+var (
+	errUpstreamNotAllowed  = errors.New("The forwarded URL is not an allowed upstream for this domain")
+	errUnauthorisedUpgrade = errors.New("Log in before opening a connection")
+	errNotRouted           = errors.New("The request was not routed via Cloud Foundry, there's no " + cfForwardedURLHeader + " header")
+	errBadForwardedURL     = errors.New("The " + cfForwardedURLHeader + " header is not a valid URL")
+	errUpstreamUnavailable = errors.New("The upstream could not be reached")
+)
+
+// forwardedURL returns the parsed X-Cf-Forwarded-Url, which must be an absolute http(s) URL
+func forwardedURL(request *http.Request) (*url.URL, error) {
+	forwarded := request.Header.Get(cfForwardedURLHeader)
+	if forwarded == "" {
+		return nil, errNotRouted
+	}
+
+	// Note that url.Parse is decoding any url-encoded characters.
+	u, err := url.Parse(forwarded)
+	if err != nil {
+		return nil, errBadForwardedURL
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, errBadForwardedURL
+	}
+
+	if port := u.Port(); port != "" {
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return nil, errBadForwardedURL
+		}
+	}
+
+	return u, nil
+}
+
+// upstreamAllowed returns true if the domain config allows forwarding to the request URL
+func upstreamAllowed(request *http.Request) bool {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil {
+		return false
+	}
+	return dc.AllowsUpstream(request.URL)
+}
+
+// upstreamRequest returns a copy of the request with the URL rewritten to the upstream
+func upstreamRequest(request *http.Request) (*http.Request, error) {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := dc.UpstreamURL(request.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	outReq := new(http.Request)
+	*outReq = *request
+	outReq.URL = u
+	return outReq, nil
+}
+
+// limitRequestBody applies the domain's max_request_body_bytes to the request, it
+// returns h.ErrBodyTooLarge straight away if the Content-Length is over the limit
+func limitRequestBody(request *http.Request) (*http.Request, *h.LimitedBody, error) {
+	dc, err := c.GetDomainConfigFromRequest(request)
+	if err != nil || dc.MaxRequestBodyBytes <= 0 || request.Body == nil || request.Body == http.NoBody {
+		return request, nil, nil
+	}
+
+	if request.ContentLength > dc.MaxRequestBodyBytes {
+		return request, nil, h.ErrBodyTooLarge
+	}
+
+	limited := h.NewLimitedBody(request.Body, dc.MaxRequestBodyBytes)
+	request.Body = limited
+	return request, limited, nil
+}
+
 // RoundTrip returns a response and error from a request
 func (lrt *AuthRoundTripper) RoundTrip(request *http.Request) (response *http.Response, err error) {
 	path := request.URL.EscapedPath()
 
 	d.Debugfln("RoundTrip:1: path: %s", path)
 
-	if strings.HasPrefix(path, "/auth") {
+	if _, fwdErr := forwardedURL(request); fwdErr != nil {
+
+		d.Debugfln("RoundTrip:2: Bad forwarded URL: %s", fwdErr.Error())
+
+		response = h.HTTPStatusResponse(http.StatusBadRequest, "Bad Request", fwdErr)
+
+	} else if sigResponse := lrt.verifySignature(request); sigResponse != nil {
+
+		d.Debugfln("RoundTrip:2: Bad signature.")
+
+		response = sigResponse
+
+	} else if i.IsAuthPath(path) {
 
 		d.Debugfln("RoundTrip:2: Auth request.")
 
@@ -114,9 +398,24 @@ func (lrt *AuthRoundTripper) RoundTrip(request *http.Request) (response *http.Re
 			response = h.HTTPErrorResponse(err)
 		}
 
+	} else if !upstreamAllowed(request) {
+
+		d.Debugfln("RoundTrip:2: Upstream not allowed: %s", request.URL.String())
+
+		a.Event("upstream_not_allowed", request, map[string]string{
+			"forwarded_url": request.Header.Get(cfForwardedURLHeader),
+		})
+		response = h.HTTPStatusResponse(http.StatusForbidden, "Upstream Not Allowed", errUpstreamNotAllowed)
+
 	} else {
 
-		var doBackEndRequest bool
+		var (
+			doBackEndRequest bool
+			forbidden        bool
+		)
+
+		authenticated, sess := i.CheckCookie(request)
+		d.Debugfln("RoundTrip:1: CheckCookie: %t", authenticated)
 
 		unauthPath := c.IsUnauthPath(request)
 		d.Debugfln("RoundTrip:1: unauthPath: %t", unauthPath)
@@ -124,32 +423,66 @@ func (lrt *AuthRoundTripper) RoundTrip(request *http.Request) (response *http.Re
 		if unauthPath {
 			doBackEndRequest = true
 		} else {
-			doBackEndRequest, _ = i.CheckCookie(request)
-			d.Debugfln("RoundTrip:1: CheckCookie: %t", doBackEndRequest)
+			doBackEndRequest = authenticated
+
+			if doBackEndRequest && !i.IsAuthorised(request, sess) {
+				forbidden = true
+			}
 		}
 
-		if doBackEndRequest {
+		if forbidden {
+
+			d.Debugfln("RoundTrip:2: Forbidden")
+			response = h.HTTPForbiddenResponse()
+
+		} else if doBackEndRequest {
 
 			d.Debugfln("RoundTrip:2: Forwarding to: %s", request.URL.String())
 
-			response, err = lrt.transport.RoundTrip(request)
-			if err != nil {
-				response = h.HTTPErrorResponse(err)
-			}
+			i.SetIdentityHeaders(request, sess, authenticated)
 
-			body, err := ioutil.ReadAll(response.Body)
+			var (
+				outReq  *http.Request
+				limited *h.LimitedBody
+			)
+			err = i.SetAssertionHeader(request, sess, authenticated)
+			if err == nil {
+				outReq, err = upstreamRequest(request)
+			}
+			if err == nil {
+				outReq, limited, err = limitRequestBody(outReq)
+			}
+			if err == nil {
+				response, err = lrt.transport.RoundTrip(outReq)
+			}
 			if err != nil {
-				response = h.HTTPErrorResponse(err)
-			} else {
-				response.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+				if errors.Is(err, h.ErrBodyTooLarge) || (limited != nil && limited.Exceeded()) {
+					response = h.HTTPStatusResponse(http.StatusRequestEntityTooLarge, "Request Too Large", h.ErrBodyTooLarge)
+				} else {
+					d.Debugfln("RoundTrip:err: %s", err.Error())
+					response = h.HTTPStatusResponse(http.StatusBadGateway, "Bad Gateway", errUpstreamUnavailable)
+				}
 			}
 
 			i.AddCookie(request, response, "", "")
 
+			if authenticated && response.StatusCode == http.StatusSwitchingProtocols {
+				if dc, err := c.GetDomainConfigFromRequest(request); err == nil && dc.CloseUpgradesAtExpiry {
+					d.Debugfln("RoundTrip:2: Closing upgraded connection at %d", sess.ExpiryTime)
+					h.CloseUpgradeAt(response, time.Unix(sess.ExpiryTime, 0))
+				}
+			}
+
 			if response.Header.Get("Cache-Control") == "" {
 				response.Header.Add("Cache-Control", "max-age=1, private")
 			}
 
+		} else if h.IsUpgradeRequest(request) {
+
+			// clients can't follow a redirect to log in during an upgrade handshake
+			d.Debugfln("RoundTrip:2: Unauthorised upgrade")
+			response = h.HTTPStatusResponse(http.StatusUnauthorized, "Unauthorised", errUnauthorisedUpgrade)
+
 		} else {
 
 			d.Debugfln("RoundTrip:2: Redirecting to login page")
@@ -0,0 +1,98 @@
+package main_test
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	s "github.com/OllieJC/authenticating-route-service"
+	i "github.com/OllieJC/authenticating-route-service/internal"
+)
+
+// BenchmarkProxyLargeResponse proxies a 2 GiB response and reports the peak heap in use,
+// which should stay flat however large the response is
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	const size = 2 << 30
+
+	os.Setenv("DOMAIN_CONFIG_FILEPATH", "test/data/example.yml")
+
+	chunk := make([]byte, 32*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		for written := 0; written < size; written += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+
+	frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+	defer frontend.Close()
+
+	sess := i.NewCustomSession()
+	sess.Provider = "Test"
+	sessJSON, _ := json.Marshal(sess)
+	beReq := httptest.NewRequest("GET", backend.URL, nil)
+	encString, err := i.EncryptSession(string(sessJSON), i.GetSessionSvrToken(beReq))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cookie := &http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString}
+
+	var (
+		peak uint64
+		mu   sync.Mutex
+		done = make(chan struct{})
+	)
+	go func() {
+		var ms runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				runtime.ReadMemStats(&ms)
+				mu.Lock()
+				if ms.HeapInuse > peak {
+					peak = ms.HeapInuse
+				}
+				mu.Unlock()
+			}
+		}
+	}()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Add("X-Cf-Forwarded-Url", backend.URL)
+		req.AddCookie(cookie)
+
+		res, err := frontend.Client().Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		copied, err := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if err != nil || copied != size {
+			b.Fatalf("copied %d bytes: %v", copied, err)
+		}
+	}
+
+	b.StopTimer()
+	close(done)
+
+	mu.Lock()
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	mu.Unlock()
+}
@@ -3,11 +3,14 @@ package main_test
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	//"github.com/jarcoal/httpmock"
@@ -15,11 +18,37 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	s "authenticating-route-service"
-	i "authenticating-route-service/internal"
-	g "authenticating-route-service/internal/google"
+	s "github.com/OllieJC/authenticating-route-service"
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	g "github.com/OllieJC/authenticating-route-service/internal/google"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	rs "github.com/OllieJC/authenticating-route-service/internal/routeservice"
+
+	"golang.org/x/net/websocket"
 )
 
+// sessionCookie returns a valid session cookie for the backend URL's domain
+func sessionCookie(beURL string) *http.Cookie {
+	return sessionCookieExpiring(beURL, time.Time{})
+}
+
+// sessionCookieExpiring returns a session cookie which expires at the time, unless it's zero
+func sessionCookieExpiring(beURL string, expiry time.Time) *http.Cookie {
+	sess := i.NewCustomSession()
+	sess.Provider = "Test"
+	if !expiry.IsZero() {
+		sess.ExpiryTime = expiry.Unix()
+	}
+	b, err := json.Marshal(sess)
+	Expect(err).NotTo(HaveOccurred())
+
+	beReq := httptest.NewRequest("GET", beURL, nil)
+	encString, err := i.EncryptSession(string(b), i.GetSessionSvrToken(beReq))
+	Expect(err).NotTo(HaveOccurred())
+
+	return &http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString}
+}
+
 var _ = Describe("Main", func() {
 	os.Setenv("DOMAIN_CONFIG_FILEPATH", "test/data/example.yml")
 
@@ -58,10 +87,11 @@ var _ = Describe("Main", func() {
 		b, err := json.Marshal(sess)
 		Expect(err).NotTo(HaveOccurred())
 
-		encString, err := i.Encrypt(string(b), "")
+		beReq := httptest.NewRequest("GET", backend.URL, nil)
+		encString, err := i.Encrypt(string(b), i.GetSessionSvrToken(beReq))
 		Expect(err).NotTo(HaveOccurred())
 
-		cookie := &http.Cookie{Name: "_session", Value: encString, Expires: time.Now().Add(6 * time.Hour)}
+		cookie := &http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString, Expires: time.Now().Add(6 * time.Hour)}
 		req.AddCookie(cookie)
 
 		req.Close = true
@@ -80,9 +110,539 @@ var _ = Describe("Main", func() {
 		Expect(res.Header.Get(metaHeader)).To(Equal(expectedMeta))
 	})
 
+	It("should keep sessions for domains with different cookie names and keys isolated", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		backendURL, err := url.Parse(backend.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		loopbackURL := fmt.Sprintf("http://127.0.0.1:%s/", backendURL.Port())
+		localhostURL := fmt.Sprintf("http://localhost:%s/", backendURL.Port())
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		client := frontend.Client()
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		newCookie := func(beURL string) *http.Cookie {
+			sess := i.NewCustomSession()
+			sess.Provider = "Test"
+			b, err := json.Marshal(sess)
+			Expect(err).NotTo(HaveOccurred())
+
+			beReq := httptest.NewRequest("GET", beURL, nil)
+			encString, err := i.EncryptSession(string(b), i.GetSessionSvrToken(beReq))
+			Expect(err).NotTo(HaveOccurred())
+
+			return &http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString}
+		}
+
+		get := func(beURL string, cookie *http.Cookie) *http.Response {
+			req, _ := http.NewRequest("GET", frontend.URL, nil)
+			req.Header.Add("X-Cf-Forwarded-Url", beURL)
+			req.AddCookie(cookie)
+			req.Close = true
+
+			res, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res
+		}
+
+		loopbackCookie := newCookie(loopbackURL)
+		localhostCookie := newCookie(localhostURL)
+
+		Expect(loopbackCookie.Name).To(Equal("_sessionLOOPBACK"))
+		Expect(localhostCookie.Name).To(Equal("_sessionLOCALHOST"))
+
+		for n := 0; n < 2; n++ {
+			res := get(loopbackURL, loopbackCookie)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Cookies()[0].Name).To(Equal("_sessionLOOPBACK"))
+
+			res = get(localhostURL, localhostCookie)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Cookies()[0].Name).To(Equal("_sessionLOCALHOST"))
+		}
+
+		// a session from one domain can't be used on the other, even with the other's cookie name
+		res := get(localhostURL, &http.Cookie{Name: localhostCookie.Name, Value: loopbackCookie.Value})
+		Expect(res.StatusCode).To(Equal(http.StatusSeeOther))
+
+		res = get(loopbackURL, &http.Cookie{Name: loopbackCookie.Name, Value: localhostCookie.Value})
+		Expect(res.StatusCode).To(Equal(http.StatusSeeOther))
+	})
+
+	It("should only forward requests with a valid route service signature when a secret is set", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		verifier, err := rs.NewVerifier([]string{"route-service-secret"}, 0)
+		Expect(err).NotTo(HaveOccurred())
+
+		roundTripper := s.NewAuthRoundTripper(false)
+		roundTripper.SignatureVerifier = verifier
+
+		frontend := httptest.NewServer(s.NewProxy(roundTripper))
+		defer frontend.Close()
+
+		sess := i.NewCustomSession()
+		sess.Provider = "Test"
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+
+		beReq := httptest.NewRequest("GET", backend.URL, nil)
+		encString, err := i.EncryptSession(string(b), i.GetSessionSvrToken(beReq))
+		Expect(err).NotTo(HaveOccurred())
+		cookie := &http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString}
+
+		get := func(sig string, meta string) *http.Response {
+			req, _ := http.NewRequest("GET", frontend.URL, nil)
+			req.Header.Add("X-Cf-Forwarded-Url", backend.URL)
+			req.Header.Add("X-CF-Proxy-Signature", sig)
+			req.Header.Add("X-CF-Proxy-Metadata", meta)
+			req.AddCookie(cookie)
+			req.Close = true
+
+			res, err := frontend.Client().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res
+		}
+
+		sig, meta, err := rs.Sign("route-service-secret", backend.URL, time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(sig, meta).StatusCode).To(Equal(http.StatusOK))
+
+		Expect(get("", "").StatusCode).To(Equal(http.StatusBadRequest))
+
+		sig, meta, err = rs.Sign("route-service-secret", "http://example.local/", time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(sig, meta).StatusCode).To(Equal(http.StatusForbidden))
+
+		sig, meta, err = rs.Sign("route-service-secret", backend.URL, time.Now().Add(-5*time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(get(sig, meta).StatusCode).To(Equal(http.StatusForbidden))
+	})
+
+	It("should forward paths which only start with /auth to the backend", func() {
+		var received *http.Request
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		get := func(path string) (*http.Response, string) {
+			req, _ := http.NewRequest("GET", frontend.URL, nil)
+			req.Header.Add("X-Cf-Forwarded-Url", backend.URL+path)
+			req.AddCookie(sessionCookie(backend.URL))
+			req.Close = true
+
+			res, err := frontend.Client().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			body, _ := ioutil.ReadAll(res.Body)
+			return res, string(body)
+		}
+
+		received = nil
+		res, body := get("/authors")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("hi"))
+		Expect(received).NotTo(BeNil())
+		Expect(received.URL.Path).To(Equal("/authors"))
+
+		received = nil
+		res, body = get("/auth/status")
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("true"))
+		Expect(received).To(BeNil())
+	})
+
+	It("should return an error page instead of forwarding to an unconfigured host", func() {
+		backendHit := false
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			backendHit = true
+		}))
+		defer backend.Close()
+
+		backendURL, err := url.Parse(backend.URL)
+		Expect(err).NotTo(HaveOccurred())
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+"/test/unauth", nil)
+		req.Header.Add("X-Cf-Forwarded-Url", fmt.Sprintf("http://127.0.0.2:%s/test/unauth", backendURL.Port()))
+		req.Close = true
+		res, err := frontend.Client().Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+		bodyBytes, err := ioutil.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bodyBytes)).To(ContainSubstring("Upstream Not Allowed"))
+		Expect(backendHit).To(BeFalse())
+	})
+
+	It("should forward to the rewritten upstream keeping the path, query and Host header", func() {
+		var received *http.Request
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		tempDir, err := ioutil.TempDir("", "rewrite")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tempDir)
+
+		configPath := filepath.Join(tempDir, "rewrite.yml")
+		Expect(ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`domains:
+  - domain: rewrite.example.local
+    enabled: true
+    session_server_token: "REWRITE-0123456789abcdef0123456789abcdef"
+    unauthenticated_paths: ["/public"]
+    upstream:
+      rewrite_url: "%s"
+`, backend.URL)), 0600)).To(Succeed())
+
+		os.Setenv("DOMAIN_CONFIG_FILEPATH", configPath)
+		defer os.Setenv("DOMAIN_CONFIG_FILEPATH", "test/data/example.yml")
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL+"/public/page?q=1", nil)
+		req.Header.Add("X-Cf-Forwarded-Url", "https://rewrite.example.local/public/page?q=1")
+		req.Close = true
+		res, err := frontend.Client().Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(received).NotTo(BeNil())
+		Expect(received.URL.Path).To(Equal("/public/page"))
+		Expect(received.URL.RawQuery).To(Equal("q=1"))
+		Expect(received.Host).To(Equal("rewrite.example.local"))
+	})
+
+	It("should proxy Host matched requests to the upstream_url in standalone mode", func() {
+		var received *http.Request
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		tempDir, err := ioutil.TempDir("", "standalone")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tempDir)
+
+		configPath := filepath.Join(tempDir, "standalone.yml")
+		Expect(ioutil.WriteFile(configPath, []byte(fmt.Sprintf(`domains:
+  - domain: standalone.example.local
+    enabled: true
+    session_server_token: "STANDALONE-0123456789abcdef0123456789abcdef"
+    unauthenticated_paths: ["/public"]
+    upstream_url: "%s"
+  - domain: nourl.example.local
+    enabled: true
+    session_server_token: "NOURL-0123456789abcdef0123456789abcdef"
+`, backend.URL)), 0600)).To(Succeed())
+
+		os.Setenv("DOMAIN_CONFIG_FILEPATH", configPath)
+		defer os.Setenv("DOMAIN_CONFIG_FILEPATH", "test/data/example.yml")
+
+		frontend := httptest.NewServer(s.NewStandaloneProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		client := frontend.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		get := func(host string, path string, cookie *http.Cookie) (*http.Response, string) {
+			req, _ := http.NewRequest("GET", frontend.URL+path, nil)
+			req.Host = host
+			// only gorouter sets this, so it's ignored in standalone mode
+			req.Header.Add("X-Cf-Forwarded-Url", "https://example.local/elsewhere")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			req.Close = true
+
+			res, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer res.Body.Close()
+			body, _ := ioutil.ReadAll(res.Body)
+			return res, string(body)
+		}
+
+		received = nil
+		res, body := get("standalone.example.local", "/public/page?q=1", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("hi"))
+		Expect(received).NotTo(BeNil())
+		Expect(received.URL.Path).To(Equal("/public/page"))
+		Expect(received.URL.RawQuery).To(Equal("q=1"))
+		Expect(received.Host).To(Equal("standalone.example.local"))
+
+		received = nil
+		res, _ = get("standalone.example.local", "/private", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusSeeOther))
+		Expect(res.Header.Get("Location")).To(Equal("/auth/login"))
+		Expect(received).To(BeNil())
+
+		res, body = get("standalone.example.local", "/private", sessionCookie("http://standalone.example.local/"))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("hi"))
+
+		res, body = get("standalone.example.local", "/auth/status", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("false"))
+
+		received = nil
+		res, body = get("standalone.example.local", "/authors", sessionCookie("http://standalone.example.local/"))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("hi"))
+		Expect(received.URL.Path).To(Equal("/authors"))
+
+		res, _ = get("nourl.example.local", "/public/page", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+		// the login pages are still served, for forward auth
+		res, body = get("nourl.example.local", "/auth/status", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("false"))
+
+		// only /auth and /auth/* are the service's, not paths which start with "/auth"
+		res, _ = get("nourl.example.local", "/authors", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+
+		res, _ = get("unknown.example.local", "/public/page", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should print every problem in a config file with validate-config", func() {
+		var out strings.Builder
+		Expect(s.ValidateConfigCommand([]string{"test/data/example.yml"}, &out)).To(Equal(0))
+		Expect(out.String()).To(Equal("test/data/example.yml: OK\n"))
+
+		tempDir, err := ioutil.TempDir("", "validate")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tempDir)
+
+		configPath := filepath.Join(tempDir, "invalid.yml")
+		Expect(ioutil.WriteFile(configPath, []byte(`domains:
+  - domain: invalid.example.local
+    enabled: true
+    session_server_token: "short"
+    sesion_cookie_name: "TYPO"
+`), 0600)).To(Succeed())
+
+		out.Reset()
+		Expect(s.ValidateConfigCommand([]string{configPath}, &out)).To(Equal(1))
+		Expect(out.String()).To(ContainSubstring(configPath + ":5: yaml: field sesion_cookie_name not found"))
+		Expect(out.String()).To(ContainSubstring(configPath + ":4: domains[0].session_server_token: must be at least 32 characters"))
+
+		out.Reset()
+		Expect(s.ValidateConfigCommand([]string{"test/data/bad.yml"}, &out)).To(Equal(1))
+	})
+
+	It("should add security headers to plain text error pages when the templates are broken", func() {
+		defer func(path string) { h.TemplatePath = path }(h.TemplatePath)
+		h.TemplatePath = "web/missing"
+
+		frontend := httptest.NewServer(s.NewForwardAuthHandler(s.NewProxy(s.NewAuthRoundTripper(false))))
+		defer frontend.Close()
+
+		for _, path := range []string{"/not-routed", "/auth/verify"} {
+			req, _ := http.NewRequest("GET", frontend.URL+path, nil)
+			req.Header.Set("X-Forwarded-Host", "unknown.example.local")
+			req.Close = true
+
+			res, err := frontend.Client().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+
+			Expect(res.StatusCode).To(BeNumerically(">=", 400), path)
+			Expect(res.Header.Get("Content-Type")).To(HavePrefix("text/plain"), path)
+			Expect(res.Header.Get("X-Frame-Options")).To(Equal("DENY"), path)
+			Expect(res.Header.Get("X-Content-Type-Options")).To(Equal("nosniff"), path)
+		}
+	})
+
+	It("should answer forward auth requests which weren't routed via gorouter", func() {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("backend"))
+		}))
+		defer backend.Close()
+
+		frontend := httptest.NewServer(s.NewForwardAuthHandler(s.NewProxy(s.NewAuthRoundTripper(false))))
+		defer frontend.Close()
+
+		verify := func(cookie *http.Cookie) *http.Response {
+			req, _ := http.NewRequest("GET", frontend.URL+"/auth/verify", nil)
+			req.Header.Set("X-Forwarded-Proto", "http")
+			req.Header.Set("X-Forwarded-Host", "localhost")
+			req.Header.Set("X-Forwarded-Uri", "/private")
+			if cookie != nil {
+				req.AddCookie(cookie)
+			}
+			req.Close = true
+
+			res, err := frontend.Client().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res
+		}
+
+		res := verify(nil)
+		Expect(res.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(res.Header.Get(i.LoginURLHeader)).To(Equal("http://localhost/auth/login"))
+
+		Expect(verify(sessionCookie("http://localhost/")).StatusCode).To(Equal(http.StatusOK))
+
+		// requests from gorouter are proxied as before
+		req, _ := http.NewRequest("GET", frontend.URL+"/auth/verify", nil)
+		req.Header.Add("X-Cf-Forwarded-Url", backend.URL+"/auth/verify")
+		req.Close = true
+		res, err := frontend.Client().Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		res.Body.Close()
+		Expect(res.Header.Get(i.LoginURLHeader)).To(BeEmpty())
+	})
+
+	It("should stream request bodies up to max_request_body_bytes and reject larger ones", func() {
+		var received []byte
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received, _ = ioutil.ReadAll(r.Body)
+			w.Write([]byte("hi"))
+		}))
+		defer backend.Close()
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		post := func(body io.Reader) *http.Response {
+			req, _ := http.NewRequest("POST", frontend.URL, body)
+			req.Header.Add("X-Cf-Forwarded-Url", backend.URL)
+			req.AddCookie(sessionCookie(backend.URL))
+			req.Close = true
+
+			res, err := frontend.Client().Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			return res
+		}
+
+		Expect(post(strings.NewReader(strings.Repeat("a", 1024))).StatusCode).To(Equal(http.StatusOK))
+		Expect(received).To(HaveLen(1024))
+
+		Expect(post(strings.NewReader(strings.Repeat("a", 1025))).StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+
+		// without a Content-Length the limit is applied while streaming
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte(strings.Repeat("a", 4096)))
+			pw.Close()
+		}()
+		Expect(post(pr).StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should stream responses to the client as the backend writes them", func() {
+		release := make(chan struct{})
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: first\n\n"))
+			w.(http.Flusher).Flush()
+			<-release
+			w.Write([]byte("data: second\n\n"))
+		}))
+		defer backend.Close()
+		defer close(release)
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Header.Add("X-Cf-Forwarded-Url", backend.URL)
+		req.AddCookie(sessionCookie(backend.URL))
+		req.Close = true
+
+		res, err := frontend.Client().Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+
+		buf := make([]byte, len("data: first\n\n"))
+		_, err = io.ReadFull(res.Body, buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(buf)).To(Equal("data: first\n\n"))
+	})
+
+	It("should proxy WebSocket upgrades for authenticated sessions only", func() {
+		backend := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+			io.Copy(ws, ws)
+		}))
+		defer backend.Close()
+
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		dial := func(cookie *http.Cookie) (*websocket.Conn, error) {
+			config, err := websocket.NewConfig(strings.Replace(frontend.URL, "http", "ws", 1), backend.URL)
+			Expect(err).NotTo(HaveOccurred())
+			config.Header.Set("X-Cf-Forwarded-Url", backend.URL)
+			if cookie != nil {
+				config.Header.Set("Cookie", cookie.String())
+			}
+			return websocket.DialConfig(config)
+		}
+
+		_, err := dial(nil)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("bad status"))
+
+		ws, err := dial(sessionCookie(backend.URL))
+		Expect(err).NotTo(HaveOccurred())
+		defer ws.Close()
+
+		Expect(websocket.Message.Send(ws, "hello")).To(Succeed())
+		var msg string
+		Expect(websocket.Message.Receive(ws, &msg)).To(Succeed())
+		Expect(msg).To(Equal("hello"))
+
+		// 127.0.0.1 closes upgraded connections when the session expires
+		expiring, err := dial(sessionCookieExpiring(backend.URL, time.Now().Add(2*time.Second)))
+		Expect(err).NotTo(HaveOccurred())
+		defer expiring.Close()
+
+		Expect(websocket.Message.Send(expiring, "before")).To(Succeed())
+		Expect(websocket.Message.Receive(expiring, &msg)).To(Succeed())
+		Expect(msg).To(Equal("before"))
+
+		expiring.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err = websocket.Message.Receive(expiring, &msg)
+		Expect(err).To(Equal(io.EOF))
+	})
+
 	It("should respond to an unauth path with the 'X-Cf-Forwarded-Url' and no session set", func() {
 		const (
-			expected          = "lookup example.local"
+			expected          = "The upstream could not be reached"
 			skipSslValidation = false
 			sigHeader         = "X-CF-Proxy-Signature"
 			metaHeader        = "X-CF-Proxy-Metadata"
@@ -121,6 +681,7 @@ var _ = Describe("Main", func() {
 		bodyBytes, err := ioutil.ReadAll(res.Body)
 		Expect(err).NotTo(HaveOccurred())
 		Expect(string(bodyBytes)).To(ContainSubstring(expected))
+		Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
 
 		Expect(len(res.Header)).Should(BeNumerically(">", 0))
 
@@ -128,6 +689,69 @@ var _ = Describe("Main", func() {
 		Expect(res.Header.Get(metaHeader)).To(Equal(expectedMeta))
 	})
 
+	It("should require a session for paths which only look like unauth paths", func() {
+		frontend := httptest.NewServer(s.NewProxy(s.NewAuthRoundTripper(false)))
+		defer frontend.Close()
+
+		client := frontend.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		for _, target := range []string{"/test/unauth/../admin", "/test/unauth/%2e%2e/admin", "/test/unauthorised"} {
+			req, _ := http.NewRequest("GET", frontend.URL, nil)
+			// example.local isn't reachable, so forwarding would be a 502
+			req.Header.Add("X-Cf-Forwarded-Url", "http://example.local"+target)
+			req.Close = true
+
+			res, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusSeeOther), target)
+			Expect(res.Header.Get("Location")).To(Equal("/auth/login"))
+		}
+	})
+
+	It("should return forbidden when the session user is not allowed by the access rules", func() {
+		const (
+			expectedBody      = "Forbidden"
+			skipSslValidation = false
+		)
+
+		roundTripper := s.NewAuthRoundTripper(skipSslValidation)
+		proxyHandler := s.NewProxy(roundTripper)
+
+		frontend := httptest.NewServer(proxyHandler)
+		defer frontend.Close()
+
+		reqBeUrl := "http://example.local/admin"
+		beReq := httptest.NewRequest("GET", reqBeUrl, nil)
+
+		sess := i.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "someone@email.example.local", "organisations": ["other-org"]}`
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+
+		encString, err := i.Encrypt(string(b), i.GetSessionSvrToken(beReq))
+		Expect(err).NotTo(HaveOccurred())
+
+		req, _ := http.NewRequest("GET", frontend.URL+"/admin", nil)
+		req.Header.Add("X-Cf-Forwarded-Url", reqBeUrl)
+		req.AddCookie(&http.Cookie{Name: i.GetSessionCookieName(beReq), Value: encString})
+		req.Close = true
+		res, err := frontend.Client().Do(req)
+
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+
+		bodyBytes, err := ioutil.ReadAll(res.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(bodyBytes)).To(ContainSubstring(expectedBody))
+	})
+
 	It("should return bad email when post to /auth/login", func() {
 		const (
 			notExpectedBody   = "hello"
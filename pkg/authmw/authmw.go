@@ -0,0 +1,212 @@
+// Package authmw embeds the authenticating route service in a Go application as net/http
+// middleware, mounting the /auth pages and only passing authenticated requests through.
+package authmw
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	c "github.com/OllieJC/authenticating-route-service/internal/configurator"
+	h "github.com/OllieJC/authenticating-route-service/internal/httphelper"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
+)
+
+const redirectCookieName = "_redirectPath"
+
+type (
+	// LoginEmailDomain is the OAuth settings for an email domain and provider
+	LoginEmailDomain = c.LoginEmailDomain
+	// AccessRule restricts matching requests to the users it allows
+	AccessRule = c.AccessRule
+	// AccessAllow lists who is allowed by an AccessRule
+	AccessAllow = c.AccessAllow
+	// JWTAssertion configures the signed JWT added to authenticated requests
+	JWTAssertion = c.JWTAssertion
+	// JWTKey is a PEM encoded private key used to sign JWT assertions
+	JWTKey = c.JWTKey
+)
+
+// Options are the settings for a domain, as in the route service's domain config file
+type Options struct {
+	Domain               string
+	AuthPageTitle        string
+	LoginEmailDomains    []LoginEmailDomain
+	SessionCookieName    string
+	SessionServerTokens  []string
+	SecurityHeaders      map[string]string
+	IdentityHeaders      map[string]string
+	JWTAssertion         JWTAssertion
+	UnauthenticatedPaths []string
+	AccessRules          []AccessRule
+
+	// TemplatePath and StaticAssetPath are where the web/template and web/static
+	// directories are, they default to the paths relative to the working directory.
+	// They are shared by every middleware in the process, so the last one set is used.
+	TemplatePath    string
+	StaticAssetPath string
+}
+
+func (o Options) domainConfig() c.DomainConfig {
+	return c.DomainConfig{
+		Domain:               o.Domain,
+		AuthPageTitle:        o.AuthPageTitle,
+		Enabled:              true,
+		LoginEmailDomains:    o.LoginEmailDomains,
+		SessionCookieName:    o.SessionCookieName,
+		SessionServerTokens:  o.SessionServerTokens,
+		SecurityHeaders:      o.SecurityHeaders,
+		IdentityHeaders:      o.IdentityHeaders,
+		JWTAssertion:         o.JWTAssertion,
+		UnauthenticatedPaths: o.UnauthenticatedPaths,
+		AccessRules:          o.AccessRules,
+	}
+}
+
+// Identity is the authenticated user of a request
+type Identity struct {
+	Provider string
+	User     string
+	Email    string
+	Name     string
+	Groups   []string
+}
+
+type contextKey struct{}
+
+// IdentityFromContext returns the identity added to an authenticated request's context
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	ident, ok := ctx.Value(contextKey{}).(Identity)
+	return ident, ok
+}
+
+type middleware struct {
+	domain string
+	next   http.Handler
+}
+
+// New returns middleware for the domain which serves /auth, redirects requests without a
+// session to log in and passes the rest to next with the identity in their context. The
+// options are checked like a config file, so an error is returned for problems such as a
+// missing or short session token. The domain's settings are registered for the process,
+// a later New for the same domain replaces them until Unregister is called.
+func New(opts Options, next http.Handler) (http.Handler, error) {
+	dc := opts.domainConfig()
+	if err := (c.Config{DomainConfigs: []c.DomainConfig{dc}}).Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.TemplatePath != "" {
+		h.TemplatePath = opts.TemplatePath
+	}
+	if opts.StaticAssetPath != "" {
+		i.StaticAssetPath = opts.StaticAssetPath
+	}
+
+	c.Register(dc)
+
+	return &middleware{domain: opts.Domain, next: next}, nil
+}
+
+// domainRequest returns a copy of the request with an absolute URL for the domain, as the
+// session and config lookups expect
+func (m *middleware) domainRequest(r *http.Request) *http.Request {
+	req := r.Clone(r.Context())
+
+	req.URL.Scheme = "http"
+	if r.TLS != nil || strings.ToLower(r.Header.Get("X-Forwarded-Proto")) == "https" {
+		req.URL.Scheme = "https"
+	}
+	req.URL.Host = m.domain
+	return req
+}
+
+func writeResponse(w http.ResponseWriter, request *http.Request, response *http.Response) {
+	h.AddSecurityHeaders(request, response)
+	h.WriteResponse(w, response)
+}
+
+// Unregister removes the settings registered for the domain by New, its middleware then
+// treats the domain as unknown
+func Unregister(domain string) {
+	c.Unregister(domain)
+}
+
+func (m *middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := m.domainRequest(r)
+
+	if i.IsAuthPath(request.URL.EscapedPath()) {
+		Debugfln("authmw:1: Auth request")
+
+		response, err := i.AuthRequestDecision(request)
+		if err != nil {
+			response = h.HTTPErrorResponse(err)
+		}
+		writeResponse(w, request, response)
+		return
+	}
+
+	authenticated, sess := i.CheckCookie(request)
+	unauthPath := c.IsUnauthPath(request)
+	Debugfln("authmw:1: authenticated: %t unauthPath: %t", authenticated, unauthPath)
+
+	if !authenticated && !unauthPath {
+		if h.IsUpgradeRequest(request) {
+			writeResponse(w, request, h.HTTPStatusResponse(http.StatusUnauthorized, "Unauthorised", nil))
+			return
+		}
+
+		response := h.EmptyHTTPResponse(request)
+		cookie := &http.Cookie{
+			Name:     redirectCookieName,
+			Value:    request.URL.RequestURI(),
+			Expires:  time.Now().Add(2 * time.Hour),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		}
+		response.Header.Add("Set-Cookie", cookie.String())
+		h.RedirectResponse(response, http.StatusSeeOther, "/auth/login")
+		writeResponse(w, request, response)
+		return
+	}
+
+	if !unauthPath && !i.IsAuthorised(request, sess) {
+		Debugfln("authmw:2: Forbidden")
+		writeResponse(w, request, h.HTTPForbiddenResponse())
+		return
+	}
+
+	i.SetIdentityHeaders(request, sess, authenticated)
+	if err := i.SetAssertionHeader(request, sess, authenticated); err != nil {
+		writeResponse(w, request, h.HTTPErrorResponse(err))
+		return
+	}
+
+	if authenticated {
+		if ident, ok := i.GetIdentity(sess); ok {
+			request = request.WithContext(context.WithValue(request.Context(), contextKey{}, Identity{
+				Provider: ident.Provider,
+				User:     ident.User,
+				Email:    ident.Email,
+				Name:     ident.Name,
+				Groups:   ident.Groups,
+			}))
+		}
+
+		// renew the session cookie, as the route service does with backend responses
+		renewed := h.EmptyHTTPResponse(request)
+		i.AddCookie(request, renewed, "", "")
+		for _, v := range renewed.Header["Set-Cookie"] {
+			w.Header().Add("Set-Cookie", v)
+		}
+	}
+
+	Debugfln("authmw:2: Serving: %s", request.URL.String())
+
+	// the handler sees the request's original URL, with the identity headers
+	request.URL = r.URL
+	m.next.ServeHTTP(w, request)
+}
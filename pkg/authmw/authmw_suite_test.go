@@ -0,0 +1,13 @@
+package authmw_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAuthMW(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "AuthMW Suite")
+}
@@ -0,0 +1,178 @@
+package authmw_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	i "github.com/OllieJC/authenticating-route-service/internal"
+	s "github.com/OllieJC/authenticating-route-service/pkg/authmw"
+)
+
+var _ = Describe("AuthMW", func() {
+	var (
+		server   *httptest.Server
+		received *http.Request
+	)
+
+	BeforeEach(func() {
+		app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			ident, ok := s.IdentityFromContext(r.Context())
+			if ok {
+				w.Write([]byte(ident.Email))
+			} else {
+				w.Write([]byte("anonymous"))
+			}
+		})
+
+		handler, err := s.New(s.Options{
+			Domain:               "embedded.example.local",
+			SessionCookieName:    "EMBEDDED",
+			SessionServerTokens:  []string{"EMBEDDED-TOKEN-0123456789abcdef0123456789abcdef"},
+			UnauthenticatedPaths: []string{"/public"},
+			AccessRules: []s.AccessRule{
+				{Path: "/admin", Allow: s.AccessAllow{Emails: []string{"admin@example.local"}}},
+			},
+			LoginEmailDomains: []s.LoginEmailDomain{
+				{Domain: "example.local", Provider: "github", OAuthClientID: "abc", OAuthClientSecret: "123", GitHubOrganisations: []string{"example-org"}},
+			},
+			TemplatePath:    "../../web/template",
+			StaticAssetPath: "../../web/static",
+		}, app)
+		Expect(err).NotTo(HaveOccurred())
+		server = httptest.NewServer(handler)
+		received = nil
+	})
+
+	AfterEach(func() {
+		server.Close()
+		s.Unregister("embedded.example.local")
+	})
+
+	sessionCookie := func(email string) *http.Cookie {
+		sess := i.NewCustomSession()
+		sess.Provider = "github"
+		sess.UserData = `{"login": "octocat", "email": "` + email + `", "organisations": []}`
+		b, err := json.Marshal(sess)
+		Expect(err).NotTo(HaveOccurred())
+
+		domainRequest := httptest.NewRequest("GET", "http://embedded.example.local/", nil)
+		encString, err := i.EncryptSession(string(b), i.GetSessionSvrToken(domainRequest))
+		Expect(err).NotTo(HaveOccurred())
+
+		return &http.Cookie{Name: i.GetSessionCookieName(domainRequest), Value: encString}
+	}
+
+	get := func(path string, cookie *http.Cookie) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("X-Auth-Email", "spoofed@example.local")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+
+		client := server.Client()
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+
+		res, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	It("should serve the /auth pages", func() {
+		res, body := get("/auth/status", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("false"))
+		Expect(received).To(BeNil())
+
+		res, _ = get("/auth/login", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should pass paths which only start with /auth to the application", func() {
+		res, body := get("/authors", sessionCookie("someone@example.local"))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("someone@example.local"))
+		Expect(received.URL.Path).To(Equal("/authors"))
+	})
+
+	It("should treat the domain as unknown once it is unregistered", func() {
+		s.Unregister("embedded.example.local")
+
+		res, _ := get("/private", sessionCookie("someone@example.local"))
+		Expect(res.StatusCode).NotTo(Equal(http.StatusOK))
+		Expect(received).To(BeNil())
+	})
+
+	It("should refuse options which wouldn't be accepted in a config file", func() {
+		for _, opts := range []s.Options{
+			{Domain: "weak.example.local"},
+			{Domain: "weak.example.local", SessionServerTokens: []string{"short"}},
+			{SessionServerTokens: []string{"0123456789abcdef0123456789abcdef"}},
+			{Domain: "weak.example.local", SessionServerTokens: []string{"0123456789abcdef0123456789abcdef"},
+				LoginEmailDomains: []s.LoginEmailDomain{{Domain: "example.local", Provider: "google"}}},
+		} {
+			handler, err := s.New(opts, http.NotFoundHandler())
+			Expect(err).To(HaveOccurred())
+			Expect(handler).To(BeNil())
+		}
+
+		// nothing was registered, so the domain is still unknown
+		request := httptest.NewRequest("GET", "http://weak.example.local/", nil)
+		Expect(i.GetSessionSvrTokens(request)).To(BeEmpty())
+	})
+
+	It("should redirect requests without a session to log in", func() {
+		res, _ := get("/private?q=1", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusSeeOther))
+		Expect(res.Header.Get("Location")).To(Equal("/auth/login"))
+		Expect(received).To(BeNil())
+	})
+
+	It("should pass unauthenticated paths through without an identity", func() {
+		res, body := get("/public/page", nil)
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("anonymous"))
+		Expect(received.Header.Get("X-Auth-Email")).To(BeEmpty())
+	})
+
+	It("should redirect paths which only look like unauthenticated paths to log in", func() {
+		for _, target := range []string{"/public/%2e%2e/private", "/publicity"} {
+			res, _ := get(target, nil)
+			Expect(res.StatusCode).To(Equal(http.StatusSeeOther), target)
+			Expect(received).To(BeNil())
+		}
+	})
+
+	It("should put the identity of sessions in the request context", func() {
+		res, body := get("/private?q=1", sessionCookie("someone@example.local"))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("someone@example.local"))
+		Expect(received.URL.RequestURI()).To(Equal("/private?q=1"))
+		Expect(received.Header.Get("X-Auth-Email")).To(Equal("someone@example.local"))
+		Expect(res.Header.Get("Set-Cookie")).To(HavePrefix("_sessionEMBEDDED="))
+
+		ident, ok := s.IdentityFromContext(received.Context())
+		Expect(ok).To(BeTrue())
+		Expect(ident.User).To(Equal("octocat"))
+		Expect(ident.Provider).To(Equal("github"))
+	})
+
+	It("should return forbidden when the access rules don't allow the user", func() {
+		res, _ := get("/admin", sessionCookie("someone@example.local"))
+		Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(received).To(BeNil())
+
+		res, body := get("/admin", sessionCookie("admin@example.local"))
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(body).To(Equal("admin@example.local"))
+	})
+})
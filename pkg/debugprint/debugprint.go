@@ -3,13 +3,54 @@ package debugprint
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+const redacted = "[REDACTED]"
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// Redact stops Debugfln printing the secret
+func Redact(secret string) {
+	if secret == "" {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+
+	// longest first, so a secret containing another is replaced whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// redactSecrets replaces any secrets in s
+func redactSecrets(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
+
 // Debugfln prints a new line to stdout if "DEBUG" env var is set to "true"
 func Debugfln(fStr string, args ...interface{}) string {
 	if DebugOption() {
-		res := fmt.Sprintf(fStr, args...)
+		res := redactSecrets(fmt.Sprintf(fStr, args...))
 		fmt.Fprintln(os.Stdout, res)
 		return res
 	}
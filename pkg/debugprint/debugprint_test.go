@@ -6,7 +6,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	. "authenticating-route-service/pkg/debugprint"
+	. "github.com/OllieJC/authenticating-route-service/pkg/debugprint"
 )
 
 var _ = Describe("debugprint", func() {
@@ -38,4 +38,13 @@ var _ = Describe("debugprint", func() {
 		Expect(t).To(ContainSubstring(testString))
 		Expect(t).ToNot(HaveSuffix("\n"))
 	})
+
+	It("should not print secrets which have been redacted", func() {
+		os.Setenv("DEBUG", "true")
+		Redact("s3cr3t-value")
+
+		t := Debugfln("Test: %s, %s", testString, "token=s3cr3t-value")
+
+		Expect(t).To(Equal("Test: Testing123., token=[REDACTED]"))
+	})
 })
@@ -6,7 +6,7 @@ for F in $FILES
 do
   echo "Running go test in $F"
   cd $F
-  go test
+  go test -race
   if [ $? -ne 0 ]; then
     exit 20
   fi